@@ -0,0 +1,201 @@
+package gofoxnet
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Chunker splits buffers into chunks, which are distributed
+// among the peers of a publisher. Concatenating all chunks
+// must yield the original buffer.
+type Chunker interface {
+	// Chunk splits the buffer, weights contains the
+	// relative forwarding capacity of every peer.
+	Chunk(buffer []byte, weights []float64) [][]byte
+}
+
+// Implemented by chunkers, which check their configuration
+type validatingChunker interface {
+	validate() error
+}
+
+// Split the buffer and check the chunks, so a broken
+// chunker fails the publish instead of the publisher
+func split(c Chunker, buffer []byte, weights []float64) ([][]byte, error) {
+	if v, ok := c.(validatingChunker); ok {
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	chunks := c.Chunk(buffer, weights)
+	if len(chunks) == 0 {
+		return nil, errors.New("Chunker returned no chunks")
+	}
+
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	if size != len(buffer) {
+		return nil, fmt.Errorf("Chunks have %v bytes instead of %v", size, len(buffer))
+	}
+	return chunks, nil
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// WeightedChunker creates one chunk per peer, the size of
+// each chunk is proportional to the weight of its peer.
+// This is the default chunker of a publisher.
+type WeightedChunker struct{}
+
+func (WeightedChunker) Chunk(buffer []byte, weights []float64) [][]byte {
+	if len(weights) < 1 {
+		panic("Count out of range")
+	}
+
+	// Invalid weights get nothing, if the sum is not finite,
+	// the buffer is split evenly
+	valid := func(w float64) float64 {
+		if w > 0 && !math.IsInf(w, 1) {
+			return w
+		}
+		return 0
+	}
+
+	sum := 0.0
+	for _, w := range weights {
+		sum += valid(w)
+	}
+
+	chunks := make([][]byte, len(weights))
+	offset, acc := 0, 0.0
+	for i, w := range weights {
+		acc += valid(w)
+
+		// The last chunk takes everything left,
+		// so no remainder is lost
+		end := len(buffer)
+		if i < len(weights)-1 {
+			if sum > 0 && !math.IsInf(sum, 1) {
+				end = int(math.Round(float64(len(buffer)) * acc / sum))
+			} else {
+				end = len(buffer) * (i + 1) / len(weights)
+			}
+			if end < offset {
+				end = offset
+			}
+		}
+
+		chunks[i] = buffer[offset:end]
+		offset = end
+	}
+
+	return chunks
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// FixedSizeChunker creates chunks of Size bytes, only the last
+// chunk may be smaller. The chunks are assigned to the peers
+// in turn, weights are ignored.
+type FixedSizeChunker struct {
+	Size int
+}
+
+func (c FixedSizeChunker) validate() error {
+	if c.Size < 1 {
+		return errors.New("Chunk size out of range")
+	}
+	return nil
+}
+
+func (c FixedSizeChunker) Chunk(buffer []byte, weights []float64) [][]byte {
+	if err := c.validate(); err != nil {
+		panic(err)
+	}
+
+	chunks := make([][]byte, 0, (len(buffer)+c.Size-1)/c.Size+1)
+	for len(buffer) > c.Size {
+		chunks = append(chunks, buffer[:c.Size])
+		buffer = buffer[c.Size:]
+	}
+	return append(chunks, buffer)
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// ContentDefinedChunker cuts chunks where a rolling hash of the
+// content matches, so an insertion into a buffer only changes the
+// surrounding chunks. Chunks are between MinSize and MaxSize bytes
+// and AvgSize bytes on average, weights are ignored.
+type ContentDefinedChunker struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// Random values for the gear hash
+var gearTable [256]uint64
+
+func init() {
+	// Splitmix64 with a fixed seed
+	x := uint64(0x666f786e6574)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+func (c ContentDefinedChunker) validate() error {
+	if c.MinSize < 1 || c.AvgSize < c.MinSize || c.MaxSize < c.AvgSize {
+		return errors.New("Chunk sizes out of range")
+	}
+	return nil
+}
+
+func (c ContentDefinedChunker) Chunk(buffer []byte, weights []float64) [][]byte {
+	if err := c.validate(); err != nil {
+		panic(err)
+	}
+
+	// Cut points are expected every AvgSize bytes
+	mask := uint64(1)
+	for mask < uint64(c.AvgSize) {
+		mask <<= 1
+	}
+	mask--
+
+	var chunks [][]byte
+	for len(buffer) > c.MinSize {
+		n := len(buffer)
+		if n > c.MaxSize {
+			n = c.MaxSize
+		}
+
+		var h uint64
+		end := n
+		for i := c.MinSize; i < n; i++ {
+			h = (h << 1) + gearTable[buffer[i]]
+			if h&mask == 0 {
+				end = i + 1
+				break
+			}
+		}
+
+		chunks = append(chunks, buffer[:end])
+		buffer = buffer[end:]
+	}
+	return append(chunks, buffer)
+}
@@ -0,0 +1,98 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func testChunker(t *testing.T, c Chunker, b []byte, weights []float64) [][]byte {
+	chunks := c.Chunk(b, weights)
+	if m := bytes.Join(chunks, nil); !bytes.Equal(m, b) {
+		t.Fatal("Merged chunks not equal to buffer")
+	}
+	return chunks
+}
+
+func TestWeightedChunker(t *testing.T) {
+	// Remainder bytes must not be dropped
+	chunks := testChunker(t, WeightedChunker{}, []byte("HelloWorld!"), []float64{1, 1, 1})
+	if len(chunks) != 3 {
+		t.Fatal("Wrong number of chunks:", len(chunks))
+	}
+
+	// Chunk sizes follow the weights
+	chunks = testChunker(t, WeightedChunker{}, []byte("HelloHelloHelloHelloHelloHello"), []float64{1, 2, 3})
+	for i, size := range []int{5, 10, 15} {
+		if len(chunks[i]) != size {
+			t.Fatal("Wrong size of chunk", i, ":", len(chunks[i]), "!=", size)
+		}
+	}
+
+	// More chunks than bytes
+	chunks = testChunker(t, WeightedChunker{}, []byte("Hi"), []float64{1, 1, 1, 1})
+	if len(chunks) != 4 {
+		t.Fatal("Wrong number of chunks:", len(chunks))
+	}
+
+	// Invalid weights get nothing, infinite sums split evenly
+	chunks = testChunker(t, WeightedChunker{}, []byte("HelloWorld"), []float64{-1, math.NaN(), math.Inf(1), 1})
+	if len(chunks[3]) != 10 {
+		t.Fatal("Invalid weights used:", len(chunks[3]))
+	}
+	chunks = testChunker(t, WeightedChunker{}, []byte("HelloWorld"), []float64{math.MaxFloat64, math.MaxFloat64})
+	if len(chunks[0]) != 5 {
+		t.Fatal("Infinite sum not split evenly:", len(chunks[0]))
+	}
+}
+
+func TestFixedSizeChunker(t *testing.T) {
+	chunks := testChunker(t, FixedSizeChunker{4}, []byte("HelloWorld"), []float64{1})
+	if len(chunks) != 3 || len(chunks[2]) != 2 {
+		t.Fatal("Wrong chunks:", chunks)
+	}
+}
+
+func TestContentDefinedChunker(t *testing.T) {
+	b := make([]byte, 64*1024)
+	rand.New(rand.NewSource(0)).Read(b)
+
+	c := ContentDefinedChunker{256, 1024, 4096}
+	chunks := testChunker(t, c, b, []float64{1})
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < c.MinSize || len(chunk) > c.MaxSize {
+			t.Fatal("Chunk size out of range:", len(chunk))
+		}
+	}
+
+	// Inserting a byte at the front must only change the first chunks
+	other := testChunker(t, c, append([]byte{42}, b...), []float64{1})
+	if !bytes.Equal(chunks[len(chunks)-1], other[len(other)-1]) || !bytes.Equal(chunks[len(chunks)-2], other[len(other)-2]) {
+		t.Fatal("Chunk boundaries not content defined")
+	}
+}
+
+// Drops the last byte
+type brokenChunker struct{}
+
+func (brokenChunker) Chunk(buffer []byte, weights []float64) [][]byte {
+	if len(buffer) == 0 {
+		return nil
+	}
+	return [][]byte{buffer[:len(buffer)-1]}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	for _, c := range []Chunker{FixedSizeChunker{0}, ContentDefinedChunker{}, brokenChunker{}} {
+		for _, b := range [][]byte{nil, []byte("HelloWorld")} {
+			if _, err := split(c, b, []float64{1}); err == nil {
+				t.Fatal("Invalid chunks of", c, "not rejected")
+			}
+		}
+	}
+
+	if _, err := split(FixedSizeChunker{4}, []byte("HelloWorld"), []float64{1}); err != nil {
+		t.Fatal("Valid chunks rejected:", err)
+	}
+}
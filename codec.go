@@ -0,0 +1,384 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec encodes the payload of the messages exchanged by peers.
+// Both peers of a connection have to use the same codec.
+type Codec interface {
+	// Announced in the handshake
+	Name() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// MsgpackCodec encodes messages as msgpack maps, it is the default.
+	MsgpackCodec Codec = msgpackCodec{}
+
+	// BinaryCodec is a compact codec, which writes the fields of every
+	// message in order. It is simple to implement for non-Go peers.
+	BinaryCodec Codec = binaryCodec{}
+
+	// GobCodec encodes every message as a self-describing gob.
+	GobCodec Codec = gobCodec{}
+)
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Integers are varints, floats are 8 bytes big endian, hashes are
+// raw bytes, strings and byte slices are prefixed by their length
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var w binaryWriter
+	switch m := v.(type) {
+	case *hello:
+		w.string(m.Protocol)
+		w.int(int64(m.Version))
+		w.uint(m.Node)
+		w.uint(uint64(m.Role))
+		w.string(m.Codec)
+		w.strings(m.Capabilities)
+	case *insertionPacket:
+		w.uint(m.Source)
+		w.string(m.Topic)
+		w.uint(m.Sequence)
+		w.hash(m.Hash)
+		w.int(int64(m.ChunkCount))
+		w.uint(uint64(m.Algorithm))
+		w.int(int64(m.DataShards))
+		w.int(int64(m.Size))
+		w.bool(m.Encrypted)
+		w.bytes(m.Signature)
+		w.bytes(m.Buffer)
+		w.int(int64(m.BufferIndex))
+		w.hashes(m.Proof)
+		w.uint(uint64(m.Compression))
+	case *forwardingPacket:
+		w.string(m.Topic)
+		w.hash(m.Hash)
+		w.int(int64(m.ChunkCount))
+		w.uint(uint64(m.Algorithm))
+		w.bytes(m.Buffer)
+		w.int(int64(m.BufferIndex))
+		w.hashes(m.Proof)
+		w.uint(uint64(m.Compression))
+	case *topicInterest:
+		w.strings(m.Topics)
+		w.compressions(m.Compressions)
+	case *distributorMetaInfo:
+		w.float(m.UploadCapacity)
+		w.int(int64(m.QueueDepth))
+		w.strings(m.Topics)
+		w.uint(uint64(len(m.Completed)))
+		for _, a := range m.Completed {
+			w.uint(a.Source)
+			w.string(a.Topic)
+			w.uint(a.Sequence)
+		}
+		w.strings(m.Decrypts)
+		w.compressions(m.Compressions)
+		w.int(int64(m.DatasetsCompleted))
+		w.int(int64(m.ChunksMissing))
+		w.uint(uint64(len(m.Forwarding)))
+		for _, f := range m.Forwarding {
+			w.uint(f.Peer)
+			w.float(f.Throughput)
+		}
+		w.uint(m.MemoryInUse)
+		w.uint(m.MemoryAvailable)
+	default:
+		return nil, fmt.Errorf("Binary codec does not support %T", v)
+	}
+	return w.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	r := binaryReader{data: data}
+	switch m := v.(type) {
+	case *hello:
+		m.Protocol = r.string()
+		m.Version = int(r.int())
+		m.Node = r.uint()
+		m.Role = role(r.uint())
+		m.Codec = r.string()
+		m.Capabilities = r.strings()
+	case *insertionPacket:
+		m.Source = r.uint()
+		m.Topic = r.string()
+		m.Sequence = r.uint()
+		m.Hash = r.hash()
+		m.ChunkCount = int(r.int())
+		m.Algorithm = HashAlgorithm(r.uint())
+		m.DataShards = int(r.int())
+		m.Size = int(r.int())
+		m.Encrypted = r.bool()
+		m.Signature = r.bytes()
+		m.Buffer = r.bytes()
+		m.BufferIndex = int(r.int())
+		m.Proof = r.hashes()
+		m.Compression = Compression(r.uint())
+	case *forwardingPacket:
+		m.Topic = r.string()
+		m.Hash = r.hash()
+		m.ChunkCount = int(r.int())
+		m.Algorithm = HashAlgorithm(r.uint())
+		m.Buffer = r.bytes()
+		m.BufferIndex = int(r.int())
+		m.Proof = r.hashes()
+		m.Compression = Compression(r.uint())
+	case *topicInterest:
+		m.Topics = r.strings()
+		m.Compressions = r.compressions()
+	case *distributorMetaInfo:
+		m.UploadCapacity = r.float()
+		m.QueueDepth = int(r.int())
+		m.Topics = r.strings()
+		for n := r.length(); n > 0; n-- {
+			m.Completed = append(m.Completed, streamAck{r.uint(), r.string(), r.uint()})
+		}
+		m.Decrypts = r.strings()
+		m.Compressions = r.compressions()
+		m.DatasetsCompleted = int(r.int())
+		m.ChunksMissing = int(r.int())
+		for n := r.length(); n > 0; n-- {
+			m.Forwarding = append(m.Forwarding, ForwardingStatus{r.uint(), r.float()})
+		}
+		m.MemoryInUse = r.uint()
+		m.MemoryAvailable = r.uint()
+	default:
+		return fmt.Errorf("Binary codec does not support %T", v)
+	}
+	return r.err
+}
+
+type binaryWriter struct {
+	bytes.Buffer
+}
+
+func (w *binaryWriter) uint(u uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], u)])
+}
+
+func (w *binaryWriter) int(i int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], i)])
+}
+
+func (w *binaryWriter) float(f float64) {
+	binary.Write(w, binary.BigEndian, math.Float64bits(f))
+}
+
+func (w *binaryWriter) bool(b bool) {
+	if b {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *binaryWriter) bytes(b []byte) {
+	w.uint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *binaryWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *binaryWriter) strings(s []string) {
+	w.uint(uint64(len(s)))
+	for _, e := range s {
+		w.string(e)
+	}
+}
+
+func (w *binaryWriter) hash(h Hash) {
+	w.Write(h[:])
+}
+
+func (w *binaryWriter) hashes(h []Hash) {
+	w.uint(uint64(len(h)))
+	for _, e := range h {
+		w.hash(e)
+	}
+}
+
+func (w *binaryWriter) compressions(c []Compression) {
+	w.uint(uint64(len(c)))
+	for _, e := range c {
+		w.uint(uint64(e))
+	}
+}
+
+// Reads until the first error, which is kept
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+var errBinaryTruncated = errors.New("Binary message truncated")
+
+func (r *binaryReader) fail() {
+	if r.err == nil {
+		r.err = errBinaryTruncated
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) uint() uint64 {
+	u, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return u
+}
+
+func (r *binaryReader) int() int64 {
+	i, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return i
+}
+
+func (r *binaryReader) float() float64 {
+	if len(r.data) < 8 {
+		r.fail()
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(r.data))
+	r.data = r.data[8:]
+	return f
+}
+
+func (r *binaryReader) bool() bool {
+	if len(r.data) < 1 {
+		r.fail()
+		return false
+	}
+	b := r.data[0] != 0
+	r.data = r.data[1:]
+	return b
+}
+
+// A length, which never exceeds the remaining data
+func (r *binaryReader) length() uint64 {
+	n := r.uint()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return 0
+	}
+	return n
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.length()
+	if n == 0 {
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binaryReader) strings() []string {
+	var s []string
+	for n := r.length(); n > 0; n-- {
+		s = append(s, r.string())
+	}
+	return s
+}
+
+func (r *binaryReader) hash() Hash {
+	var h Hash
+	if len(r.data) < HashSize {
+		r.fail()
+		return h
+	}
+	copy(h[:], r.data)
+	r.data = r.data[HashSize:]
+	return h
+}
+
+func (r *binaryReader) hashes() []Hash {
+	var h []Hash
+	for n := r.length(); n > 0; n-- {
+		h = append(h, r.hash())
+	}
+	return h
+}
+
+func (r *binaryReader) compressions() []Compression {
+	var c []Compression
+	for n := r.length(); n > 0; n-- {
+		c = append(c, Compression(r.uint()))
+	}
+	return c
+}
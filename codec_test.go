@@ -0,0 +1,54 @@
+package gofoxnet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	messages := []interface{}{
+		&hello{protocolName, protocolVersion, 7, insertionRole, "binary", []string{signedCapability}},
+		&insertionPacket{7, "topic", 3, Sum([]byte("hash")), 2, BLAKE2bHash, 1, 10, true, []byte("sig"), []byte("hello"), metadataOnly, []Hash{Sum([]byte("a"))}, FlateCompression},
+		&forwardingPacket{"topic", Sum([]byte("hash")), 2, SHA256Hash, []byte("hello"), 1, []Hash{Sum([]byte("b"))}, ZstdCompression},
+		&topicInterest{[]string{"a", "b"}, supportedCompressions},
+		&distributorMetaInfo{
+			UploadCapacity:    1.5,
+			QueueDepth:        2,
+			Topics:            []string{"a"},
+			Completed:         []streamAck{{7, "a", 3}},
+			Decrypts:          []string{"a"},
+			Compressions:      supportedCompressions,
+			DatasetsCompleted: 4,
+			ChunksMissing:     5,
+			Forwarding:        []ForwardingStatus{{1, 100}},
+			MemoryInUse:       6,
+			MemoryAvailable:   7,
+		},
+	}
+
+	for _, codec := range []Codec{MsgpackCodec, BinaryCodec, GobCodec} {
+		for _, m := range messages {
+			b, err := codec.Marshal(m)
+			if err != nil {
+				t.Fatal(codec.Name(), "failed to marshal", m, err)
+			}
+
+			decoded := reflect.New(reflect.TypeOf(m).Elem()).Interface()
+			if err := codec.Unmarshal(b, decoded); err != nil {
+				t.Fatal(codec.Name(), "failed to unmarshal", m, err)
+			}
+			if !reflect.DeepEqual(m, decoded) {
+				t.Fatal(codec.Name(), "changed the message:", m, "!=", decoded)
+			}
+		}
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	b, _ := BinaryCodec.Marshal(&forwardingPacket{"topic", Sum([]byte("hash")), 2, SHA512_256Hash, []byte("hello"), 1, nil, NoCompression})
+
+	var fp forwardingPacket
+	if err := BinaryCodec.Unmarshal(b[:len(b)-3], &fp); err == nil {
+		t.Fatal("Truncated message decoded:", fp)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"testing"
 )
 
 //////////////////////////////////////////////////////////////////////////
@@ -12,6 +13,7 @@ import (
 //////////////////////////////////////////////////////////////////////////
 
 type rwcBuffer struct {
+	input  *bytes.Buffer
 	buffer *bytes.Buffer
 	closed bool
 	mutex  sync.Mutex
@@ -25,6 +27,9 @@ func (r *rwcBuffer) Write(buffer []byte) (int, error) {
 func (r *rwcBuffer) Read(buffer []byte) (int, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
+	if r.input.Len() > 0 {
+		return r.input.Read(buffer)
+	}
 	for !r.closed {
 		r.cond.Wait()
 	}
@@ -39,8 +44,9 @@ func (r *rwcBuffer) Close() error {
 	return nil
 }
 
-func newRWCBuffer() *rwcBuffer {
-	b := &rwcBuffer{buffer: new(bytes.Buffer)}
+// Only the hello of a remote peer with the given role is read
+func newRWCBuffer(remote role) *rwcBuffer {
+	b := &rwcBuffer{input: bytes.NewBuffer(newHello(remote)), buffer: new(bytes.Buffer)}
 	b.cond = sync.NewCond(&b.mutex)
 	return b
 }
@@ -64,3 +70,67 @@ func (r *dummyWriteCloser) Close() error {
 func newRWC(r io.Reader) io.ReadWriteCloser {
 	return &dummyWriteCloser{r}
 }
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The framed hello of a remote peer
+func newHello(r role) []byte {
+	var b bytes.Buffer
+	newMessageWriter(&b, MsgpackCodec).write(helloMessage, &hello{protocolName, protocolVersion, 42, r, "msgpack", nil})
+	return b.Bytes()
+}
+
+// A reader, which skips the hello sent to a remote peer
+func newPeerReader(r io.Reader) *messageReader {
+	reader := newMessageReader(r, MsgpackCodec)
+	reader.read()
+	return reader
+}
+
+// Read the next message and decode it
+func receive(r *messageReader, v interface{}) error {
+	m, err := r.read()
+	if err != nil {
+		return err
+	}
+	return m.decode(v)
+}
+
+// Act as remote peer with the given role on a raw connection
+func remoteHandshake(t *testing.T, rwc io.ReadWriter, r role) (*messageWriter, *messageReader) {
+	writer := newMessageWriter(rwc, MsgpackCodec)
+	reader := newMessageReader(rwc, MsgpackCodec)
+
+	// Pipes are synchronous, so send while receiving
+	sent := make(chan error, 1)
+	go func() {
+		sent <- writer.write(helloMessage, &hello{protocolName, protocolVersion, 42, r, "msgpack", nil})
+	}()
+
+	var h hello
+	if err := receive(reader, &h); err != nil {
+		t.Fatal("Failed to receive hello:", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal("Failed to send hello:", err)
+	}
+	return writer, reader
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The Merkle root of the buffers and a chunk with proof for each of them
+func newTestChunks(buffers [][]byte) (Hash, []chunk) {
+	tree := newMerkleTree(SHA512_256Hash, buffers)
+	root := tree.root()
+
+	chunks := make([]chunk, len(buffers))
+	for i, b := range buffers {
+		chunks[i] = chunk{root, b, i, tree.proof(i)}
+	}
+	return root, chunks
+}
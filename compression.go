@@ -0,0 +1,102 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress chunks on the wire.
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	FlateCompression
+	ZstdCompression
+)
+
+// The compressions every peer is able to decompress, peers
+// announce them, so old peers only receive raw chunks
+var supportedCompressions = []Compression{FlateCompression, ZstdCompression}
+
+// Safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// The compression to use for a link, if the remote peer supports it
+func negotiate(preferred Compression, supported []Compression) Compression {
+	for _, c := range supported {
+		if c == preferred {
+			return c
+		}
+	}
+	return NoCompression
+}
+
+// Compress the chunk, chunks which do not get
+// smaller are sent without compression
+func compress(c Compression, buffer []byte) ([]byte, Compression) {
+	// Peers never decompress more than a message
+	if len(buffer) > maxMessageSize {
+		return buffer, NoCompression
+	}
+
+	var compressed []byte
+	switch c {
+	case FlateCompression:
+		var b bytes.Buffer
+		w, _ := flate.NewWriter(&b, flate.DefaultCompression)
+		w.Write(buffer)
+		w.Close()
+		compressed = b.Bytes()
+	case ZstdCompression:
+		compressed = zstdEncoder.EncodeAll(buffer, nil)
+	default:
+		return buffer, NoCompression
+	}
+
+	if len(compressed) >= len(buffer) {
+		return buffer, NoCompression
+	}
+	return compressed, c
+}
+
+// Decompress at most size bytes and never more than a message,
+// so a small packet cannot make a peer allocate too much memory
+func decompress(c Compression, buffer []byte, size int) ([]byte, error) {
+	if size > maxMessageSize {
+		size = maxMessageSize
+	}
+
+	var r io.Reader
+	switch c {
+	case NoCompression:
+		return buffer, nil
+	case FlateCompression:
+		r = flate.NewReader(bytes.NewReader(buffer))
+	case ZstdCompression:
+		window := uint64(size)
+		if window < zstd.MinWindowSize {
+			window = zstd.MinWindowSize
+		}
+		d, err := zstd.NewReader(bytes.NewReader(buffer), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(window))
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		r = d
+	default:
+		return nil, errors.New("Unknown compression")
+	}
+
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > size {
+		return nil, errors.New("Decompressed chunk too large")
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,59 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestCompression(t *testing.T) {
+	buffer := bytes.Repeat([]byte("helloworldworks"), 100)
+
+	for _, c := range supportedCompressions {
+		compressed, used := compress(c, buffer)
+		if used != c || len(compressed) >= len(buffer) {
+			t.Fatal("Compression", c, "not applied")
+		}
+
+		decompressed, err := decompress(used, compressed, len(buffer))
+		if err != nil {
+			t.Fatal("Decompression", c, "failed:", err)
+		}
+		if !bytes.Equal(decompressed, buffer) {
+			t.Fatal("Compression", c, "changed the buffer")
+		}
+	}
+
+	// More than the size of the dataset is never decompressed
+	bomb := make([]byte, 1<<20)
+	for _, c := range supportedCompressions {
+		compressed, _ := compress(c, bomb)
+		if _, err := decompress(c, compressed, len(bomb)-1); err == nil {
+			t.Fatal("Decompression", c, "not limited")
+		}
+	}
+
+	// Chunks, which do not get smaller, are sent raw
+	if _, used := compress(ZstdCompression, []byte("hello")); used != NoCompression {
+		t.Fatal("Incompressible chunk compressed")
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	// Old peers do not announce any compression
+	if c := negotiate(ZstdCompression, nil); c != NoCompression {
+		t.Fatal("Compressed for an old peer:", c)
+	}
+
+	var b bytes.Buffer
+	msgpack.NewEncoder(&b).Encode(&topicInterest{nil, supportedCompressions})
+
+	var ti topicInterest
+	if err := msgpack.NewDecoder(&b).Decode(&ti); err != nil {
+		t.Fatal("Decoding failed:", err)
+	}
+	if c := negotiate(FlateCompression, ti.Compressions); c != FlateCompression {
+		t.Fatal("Supported compression not negotiated:", c)
+	}
+}
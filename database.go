@@ -1,25 +1,70 @@
 package gofoxnet
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
-const emptyHash = ""
-
 type chunk struct {
-	hash        string
+	hash        Hash
 	buffer      []byte
 	bufferIndex int
+
+	// The siblings on the path to the Merkle root
+	proof []Hash
 }
 
 type metadata struct {
-	hash        string
-	splitHashes []string
+	// The Merkle root of all chunks
+	hash       Hash
+	chunkCount int
+
+	// Used to verify the dataset and its chunks
+	algorithm HashAlgorithm
+
+	// Only set for erasure coded datasets,
+	// zero means that every chunk is necessary
+	dataShards int
+
+	// The size of the merged dataset
+	size int
+
+	// Whether the merged dataset is encrypted for the topic
+	encrypted bool
+
+	// Used to deliver datasets in order
+	source   uint64
+	topic    string
+	sequence uint64
+}
+
+// Metadata comes from other peers, so it has to be checked
+// before the chunk count or the size is used for anything
+func (md *metadata) validate() error {
+	if md.chunkCount < 1 || md.chunkCount > maxChunkCount {
+		return fmt.Errorf("Dataset %v has an invalid chunk count of %v", md.hash, md.chunkCount)
+	}
+	if md.dataShards < 0 || md.dataShards > md.chunkCount {
+		return fmt.Errorf("Dataset %v has an invalid number of %v data shards", md.hash, md.dataShards)
+	}
+	if md.size < 0 {
+		return fmt.Errorf("Dataset %v has an invalid size of %v", md.hash, md.size)
+	}
+	return nil
+}
+
+func (md *metadata) position() streamPosition {
+	return streamPosition{streamKey{md.source, md.topic}, md.sequence}
 }
 
 type lookup struct {
-	hash    string
+	hash    Hash
 	resChan chan mergeResult
 }
 
@@ -34,46 +79,127 @@ type mergeResult struct {
 
 type dataset struct {
 	metadata
-	chunks      map[int][]byte
+
+	// The sizes of the chunks in the store by index
+	chunks      map[int]int
 	mergeResult *mergeResult
+
+	// The same buffer can be published more than once
+	positions []streamPosition
+
+	// The bytes of the chunks and the merged buffer, when the
+	// dataset was announced and its places in the eviction order
+	bytes int
+	added time.Time
+	age   *list.Element
+	use   *list.Element
+}
+
+// Returns false, if the position is already known
+func (d *dataset) addPosition(pos streamPosition) bool {
+	for _, p := range d.positions {
+		if p == pos {
+			return false
+		}
+	}
+	d.positions = append(d.positions, pos)
+	return true
+}
+
+// Whether the chunk has to be stored
+func (d *dataset) accepts(c chunk) bool {
+	// Replicated chunks arrive more than once, keep the first copy
+	if _, ok := d.chunks[c.bufferIndex]; ok {
+		return false
+	}
+
+	// Only verified chunks are kept, so a corrupted copy never
+	// hides an intact one and any dataShards of them are
+	// sufficient for merging erasure coded datasets
+	return d.algorithm.verifyProof(d.hash, c.buffer, c.bufferIndex, d.chunkCount, c.proof)
 }
 
 func (d *dataset) ensureChunkCount() bool {
-	return len(d.chunks) == len(d.splitHashes)
+	return len(d.chunks) >= d.requiredChunks()
 }
 
-func (d *dataset) merge() mergeResult {
+// The number of chunks necessary for merging
+func (d *dataset) requiredChunks() int {
+	if d.dataShards > 0 {
+		return d.dataShards
+	}
+	return d.chunkCount
+}
+
+func (d *dataset) merge(store Store) mergeResult {
 	if !d.ensureChunkCount() {
 		panic("Invalid chunk count")
 	}
 
-	// Calc length of all buffers
+	if d.dataShards > 0 {
+		return d.reconstruct(store)
+	}
+
+	// Make sure, the chunks add up to the size of the dataset
 	s := 0
-	for _, c := range d.chunks {
-		s += len(c)
+	for _, n := range d.chunks {
+		s += n
+	}
+	if s != d.size {
+		return mergeResult{nil, errors.New(fmt.Sprint("Chunks have ", s, " bytes instead of ", d.size))}
 	}
 
 	m := make([]byte, 0, s)
-	for i, h := range d.splitHashes {
-		c, ok := d.chunks[i]
+	chunks := make([][]byte, d.chunkCount)
+	for i := range chunks {
+		c, err := store.Chunk(d.hash, i)
 
 		// Make sure, there the chunk exists
-		if !ok {
-			return mergeResult{nil, errors.New(fmt.Sprint("Chunk with index", i, "not found"))}
-		}
-
-		// Verify the split hash
-		if h != Hash(c) {
-			return mergeResult{nil, errors.New(fmt.Sprint("Chunk", i, "corrupted"))}
+		if err != nil {
+			return mergeResult{nil, errors.New(fmt.Sprint("Chunk with index ", i, " not found: ", err))}
 		}
 
 		// Append to merged buffer
 		m = append(m, c...)
+		chunks[i] = m[len(m)-len(c):]
+	}
+
+	// The store might have been changed since the chunks were verified
+	if d.hash != d.algorithm.MerkleRoot(chunks) {
+		return mergeResult{nil, errors.New(fmt.Sprint("Stored chunks corrupted"))}
+	}
+
+	return mergeResult{m, nil}
+}
+
+// Whether the dataset was merged or, if it was restored
+// from the store, is able to be merged on first use
+func (d *dataset) complete() bool {
+	if d.mergeResult != nil {
+		return d.mergeResult.err == nil
+	}
+	return d.ensureChunkCount()
+}
+
+func (d *dataset) reconstruct(store Store) mergeResult {
+	// Missing shards stay nil
+	shards := make([][]byte, d.chunkCount)
+	for i := range d.chunks {
+		c, err := store.Chunk(d.hash, i)
+		if err != nil {
+			return mergeResult{nil, errors.New(fmt.Sprint("Chunk with index ", i, " not found: ", err))}
+		}
+		shards[i] = c
+	}
+
+	m, err := reconstruct(shards, d.dataShards, d.size)
+	if err != nil {
+		return mergeResult{nil, err}
 	}
 
-	// Verify hash
-	if d.hash != Hash(m) {
-		return mergeResult{nil, errors.New(fmt.Sprint("All chunks corrupted"))}
+	// The reconstructed shards have to match the Merkle root, too
+	if d.hash != d.algorithm.MerkleRoot(shards) {
+		return mergeResult{nil, errors.New(fmt.Sprint("Reconstructed shards corrupted"))}
 	}
 
 	return mergeResult{m, nil}
@@ -84,54 +210,228 @@ func (d *dataset) merge() mergeResult {
 //////////////////////////////////////////////////////////////////////////
 
 type database struct {
+	// Datasets, which were merged, failed to merge
+	// or were evicted, accessed atomically
+	merged        uint64
+	mergeFailures uint64
+	evicted       uint64
+
 	// Used to communicate with the database
-	addChunkChan    chan chunk
-	addMetaDataChan chan metadata
-	lookupChan      chan lookup
-	done            signalChan
-	closed          signalChan
+	addChunkChan     chan chunk
+	addMetaDataChan  chan metadata
+	lookupChan       chan lookup
+	cancelLookupChan chan lookup
+	subscribeChan    chan *subscription
+	unsubscribeChan  chan *subscription
+	statusChan       chan chan databaseStatus
+	done             signalChan
+	closed           signalChan
+
+	// Structures for storing chunks and datasets, the chunks
+	// of datasets are in the store, orphan chunks in memory
+	store    Store
+	chunks   map[Hash]*orphanChunks
+	datasets map[Hash]*dataset
+	lookups  map[Hash][]lookup
+
+	// The capacity and the bytes of all chunks and merged buffers
+	limits databaseLimits
+	bytes  int
+
+	// Datasets by announcement and by last use and
+	// orphan chunks by arrival, the first is evicted first
+	datasetsByAge *list.List
+	datasetsByUse *list.List
+	orphansByAge  *list.List
+
+	// Structures for ordered delivery
+	streams       map[streamKey]*stream
+	subscriptions []*subscription
+
+	// The keys of the encrypted topics
+	decryptionKeys map[string][]byte
+}
+
+// Merge the dataset, unless it was merged already, and keep the result
+func (d *database) merge(ds *dataset) mergeResult {
+	if ds.mergeResult != nil && ds.mergeResult.err == nil {
+		return *ds.mergeResult
+	}
+
+	res := ds.merge(d.store)
+	if res.err != nil {
+		atomic.AddUint64(&d.mergeFailures, 1)
+	} else if ds.encrypted {
+		res = d.decrypt(ds, res.buffer)
+	}
 
-	// Structures for storing chunks and datasets
-	chunks   map[string]map[int]chunk
-	datasets map[string]*dataset
-	lookups  map[string][]lookup
+	// Store the merge result
+	ds.mergeResult = &res
+	ds.bytes += len(res.buffer)
+	d.bytes += len(res.buffer)
+	d.touch(ds)
+
+	if res.err == nil {
+		atomic.AddUint64(&d.merged, 1)
+	}
+	return res
 }
 
 // Try to merge the dataset and store the result
 func (d *database) mergeAndNotify(ds *dataset) {
+	// Already merged
+	if ds.mergeResult != nil && ds.mergeResult.err == nil {
+		return
+	}
+
 	// Not enough to merge
 	if !ds.ensureChunkCount() {
 		return
 	}
 
-	// Merge and notify
-	res := ds.merge()
-
-	// Store the merge result
-	ds.mergeResult = &res
+	// Merge and deliver to subscriptions
+	res := d.merge(ds)
+	if res.err == nil {
+		for _, pos := range ds.positions {
+			d.publish(ds, pos)
+		}
+	}
 
 	// Notify listeners
 	l := d.lookups[ds.hash]
-	d.lookups[ds.hash] = nil
+	delete(d.lookups, ds.hash)
 	for _, v := range l {
-		select {
-		case v.resChan <- res:
-		case <-d.done:
+		v.resChan <- res
+	}
+}
+
+// Decrypt a verified dataset, relays without the key
+// only store its chunks
+func (d *database) decrypt(ds *dataset, buffer []byte) mergeResult {
+	key, ok := d.decryptionKeys[ds.topic]
+	if !ok {
+		return mergeResult{nil, errors.New("No key to decrypt dataset")}
+	}
+
+	m, err := decrypt(key, ds.topic, buffer)
+	if err != nil {
+		return mergeResult{nil, err}
+	}
+	return mergeResult{m, nil}
+}
+
+// The keys never change, so any goroutine may call this
+func (d *database) decryptedTopics() []string {
+	var topics []string
+	for topic := range d.decryptionKeys {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Remove a waiting lookup, if it was not notified yet
+func (d *database) removeLookup(l lookup) {
+	ls := d.lookups[l.hash]
+	for i, v := range ls {
+		if v.resChan == l.resChan {
+			ls = append(ls[:i], ls[i+1:]...)
+			break
+		}
+	}
+
+	if len(ls) == 0 {
+		delete(d.lookups, l.hash)
+	} else {
+		d.lookups[l.hash] = ls
+	}
+}
+
+// Store a chunk of the dataset and count its bytes
+func (d *database) insertChunk(ds *dataset, c chunk) bool {
+	if !ds.accepts(c) {
+		return false
+	}
+	if err := d.store.PutChunk(ds.hash, c.bufferIndex, c.buffer); err != nil {
+		log.Println(err)
+		return false
+	}
+	ds.chunks[c.bufferIndex] = len(c.buffer)
+	ds.bytes += len(c.buffer)
+	d.bytes += len(c.buffer)
+	return true
+}
+
+// Restore the datasets of the store, complete datasets
+// are only merged, once they are looked up or delivered
+func (d *database) load() {
+	err := d.store.Load(func(hash Hash, data []byte, chunks map[int]int) {
+		md, positions, err := decodeMetadata(data)
+		if err != nil || md.hash != hash {
+			log.Println("Failed to load dataset", hash, err)
+			return
+		}
+
+		ds := &dataset{md, make(map[int]int), nil, positions, 0, time.Now(), nil, nil}
+		for i, n := range chunks {
+			if i >= 0 && i < md.chunkCount {
+				ds.chunks[i] = n
+				ds.bytes += n
+				d.bytes += n
+			}
+		}
+		d.addDataset(ds)
+
+		for _, pos := range positions {
+			d.stream(pos.streamKey).announce(pos.sequence)
+		}
+		if ds.complete() {
+			for _, pos := range positions {
+				d.publish(ds, pos)
+			}
 		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	d.evict()
+}
+
+// Store the metadata with all positions of the dataset
+func (d *database) storeMetadata(ds *dataset) {
+	if err := d.store.PutMetadata(ds.hash, encodeMetadata(ds.metadata, ds.positions)); err != nil {
+		log.Println(err)
 	}
 }
 
-func newDatabase() *database {
+func newDatabase(decryptionKeys map[string][]byte, limits databaseLimits, store Store) *database {
 	d := &database{
+		0,
+		0,
+		0,
 		make(chan chunk),
 		make(chan metadata),
 		make(chan lookup),
+		make(chan lookup),
+		make(chan *subscription),
+		make(chan *subscription),
+		make(chan chan databaseStatus),
 		make(signalChan),
 		make(signalChan),
-		make(map[string]map[int]chunk),
-		make(map[string]*dataset),
-		make(map[string][]lookup),
+		store,
+		make(map[Hash]*orphanChunks),
+		make(map[Hash]*dataset),
+		make(map[Hash][]lookup),
+		limits,
+		0,
+		list.New(),
+		list.New(),
+		list.New(),
+		make(map[streamKey]*stream),
+		nil,
+		decryptionKeys,
 	}
+	d.load()
 	go d.serve()
 	return d
 }
@@ -161,12 +461,15 @@ func (d *database) addMetaData(md metadata) {
 	}
 }
 
-func (d *database) lookup(hash string) ([]byte, error) {
-	l := lookup{hash, make(chan mergeResult)}
+func (d *database) lookup(ctx context.Context, hash Hash) ([]byte, error) {
+	// The database never waits for the result to be fetched
+	l := lookup{hash, make(chan mergeResult, 1)}
 
 	// Try to request lookup
 	select {
 	case d.lookupChan <- l:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	case <-d.done:
 		return nil, errors.New("Database stopped while requesting lookup")
 	}
@@ -175,59 +478,125 @@ func (d *database) lookup(hash string) ([]byte, error) {
 	select {
 	case res := <-l.resChan:
 		return res.buffer, res.err
+	case <-ctx.Done():
+		d.cancelLookup(l)
+		return nil, ctx.Err()
 	case <-d.done:
 		return nil, errors.New("Database stopped while waiting for lookup result")
 	}
 }
 
+func (d *database) cancelLookup(l lookup) {
+	select {
+	case d.cancelLookupChan <- l:
+	case <-d.done:
+	}
+}
+
 func (d *database) serve() {
 	defer close(d.closed)
+
+	// Expired datasets are removed regularly
+	var expire <-chan time.Time
+	if d.limits.ttl > 0 {
+		ticker := time.NewTicker(d.limits.ttl / 2)
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+
+	// Streams stop waiting for missing sequences regularly
+	var gaps <-chan time.Time
+	if d.limits.sequenceTimeout > 0 {
+		ticker := time.NewTicker(d.limits.sequenceTimeout / 2)
+		defer ticker.Stop()
+		gaps = ticker.C
+	}
+
 	for running := true; running; {
 		select {
 		case c := <-d.addChunkChan:
 			if ds, ok := d.datasets[c.hash]; ok {
 				// Datasets already exists
-				ds.chunks[c.bufferIndex] = c.buffer
-				d.mergeAndNotify(ds)
-			} else if m, ok := d.chunks[c.hash]; ok {
+				if d.insertChunk(ds, c) {
+					d.touch(ds)
+					d.mergeAndNotify(ds)
+				}
+			} else if o, ok := d.chunks[c.hash]; ok {
 				// There are chunks with the same hash
-				m[c.bufferIndex] = c
+				if _, ok := o.chunks[c.bufferIndex]; !ok {
+					o.chunks[c.bufferIndex] = c
+					o.bytes += len(c.buffer)
+					d.bytes += len(c.buffer)
+				}
 			} else {
 				// Add new chunks map
-				d.chunks[c.hash] = map[int]chunk{c.bufferIndex: c}
+				d.addOrphans(c)
 			}
+			d.evict()
 		case md := <-d.addMetaDataChan:
-			if _, ok := d.datasets[md.hash]; !ok {
+			pos := md.position()
+			if ds, ok := d.datasets[md.hash]; ok {
+				// The buffer was published again, so it
+				// has to be delivered in this stream, too
+				if ds.addPosition(pos) {
+					d.touch(ds)
+					d.storeMetadata(ds)
+					d.stream(pos.streamKey).announce(pos.sequence)
+					if ds.complete() {
+						d.publish(ds, pos)
+					}
+				}
+			} else {
 				// Create new dataset
-				ds := &dataset{md, make(map[int][]byte), nil}
-				d.datasets[md.hash] = ds
-
-				// Merge outstanding chunks
-				if m, ok := d.chunks[md.hash]; ok {
-					for _, c := range m {
-						ds.chunks[c.bufferIndex] = c.buffer
+				ds := &dataset{md, make(map[int]int), nil, []streamPosition{pos}, 0, time.Now(), nil, nil}
+				d.addDataset(ds)
+				d.storeMetadata(ds)
+				d.stream(pos.streamKey).announce(pos.sequence)
+
+				// Merge outstanding chunks and remove
+				// the chunk map for this dataset
+				if o, ok := d.chunks[md.hash]; ok {
+					d.removeOrphans(md.hash)
+					for _, c := range o.chunks {
+						d.insertChunk(ds, c)
 					}
 				}
 				d.mergeAndNotify(ds)
-
-				// Remove chunk map for this dataset
-				delete(d.chunks, md.hash)
 			}
+			d.evict()
 		case l := <-d.lookupChan:
 			if ds, exists := d.datasets[l.hash]; exists && ds.mergeResult != nil {
 				// Dataset exists and was already merged,
 				// respond with merged result directly
-				select {
-				case l.resChan <- *ds.mergeResult:
-				case <-d.done:
-				}
+				d.touch(ds)
+				l.resChan <- *ds.mergeResult
+			} else if exists && ds.complete() {
+				// Restored datasets are merged on first use
+				l.resChan <- d.merge(ds)
 			} else {
 				// Queue for further notifications
 				d.lookups[l.hash] = append(d.lookups[l.hash], l)
 			}
+		case l := <-d.cancelLookupChan:
+			d.removeLookup(l)
+		case s := <-d.subscribeChan:
+			d.subscriptions = append(d.subscriptions, s)
+		case s := <-d.unsubscribeChan:
+			d.unsubscribe(s)
+		case resChan := <-d.statusChan:
+			resChan <- d.currentStatus()
+		case now := <-expire:
+			d.expire(now)
+		case now := <-gaps:
+			d.skipGaps(now)
 		case <-d.done:
 			running = false
 			continue
 		}
 	}
+
+	// Stop all subscriptions
+	for _, s := range d.subscriptions {
+		close(s.in)
+	}
 }
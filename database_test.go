@@ -2,27 +2,29 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
 	"testing"
 	"time"
 )
 
 func TestDatabase(t *testing.T) {
-	d := newDatabase()
-	h := Hash([]byte("helloworldworks"))
-	c1 := chunk{h, []byte("hello"), 0}
-	c2 := chunk{h, []byte("world"), 1}
-	c3 := chunk{h, []byte("works"), 2}
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+	h, chunks := newTestChunks([][]byte{[]byte("hello"), []byte("world"), []byte("works")})
+	c1, c2, c3 := chunks[0], chunks[1], chunks[2]
 	md := metadata{
 		h,
-		[]string{
-			Hash([]byte("hello")),
-			Hash([]byte("world")),
-			Hash([]byte("works")),
-		},
+		3,
+		SHA512_256Hash,
+		0,
+		15,
+		false,
+		0,
+		"",
+		0,
 	}
 
 	go func() {
-		buffer, err := d.lookup(h)
+		buffer, err := d.lookup(context.Background(), h)
 		if err != nil {
 			t.Fatal("Lookup failed:", err)
 		}
@@ -43,7 +45,7 @@ func TestDatabase(t *testing.T) {
 	d.addChunk(c3)
 	d.addChunk(c3)
 
-	buffer, err := d.lookup(h)
+	buffer, err := d.lookup(context.Background(), h)
 	if err != nil {
 		t.Fatal("Lookup failed:", err)
 	}
@@ -52,3 +54,268 @@ func TestDatabase(t *testing.T) {
 		t.Fatal("Inserted and looked up buffer not equal")
 	}
 }
+
+func TestDatabaseCorruptedReplica(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+	b := []byte("helloworld")
+	h, chunks := newTestChunks([][]byte{b[:5], b[5:]})
+
+	// A corrupted copy must not hide the intact one
+	d.addMetaData(metadata{h, 2, SHA512_256Hash, 0, len(b), false, 0, "", 0})
+	d.addChunk(chunk{h, []byte("olleh"), 0, chunks[0].proof})
+	d.addChunk(chunks[0])
+	d.addChunk(chunks[1])
+
+	buffer, err := d.lookup(context.Background(), h)
+	if err != nil {
+		t.Fatal("Lookup failed:", err)
+	}
+
+	if !bytes.Equal(buffer, b) {
+		t.Fatal("Inserted and looked up buffer not equal")
+	}
+
+	d.closeAndWait()
+}
+
+func TestDatabaseErasureCoding(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+	b := []byte("helloworldworks")
+	bs, err := encode(b, 3, 2)
+	if err != nil {
+		t.Fatal("Encoding failed:", err)
+	}
+	h, chunks := newTestChunks(bs)
+
+	// A corrupted shard must not count
+	d.addMetaData(metadata{h, len(bs), SHA512_256Hash, 3, len(b), false, 0, "", 0})
+	d.addChunk(chunk{h, []byte("corrupted"), 0, chunks[0].proof})
+	d.addChunk(chunks[1])
+	d.addChunk(chunks[4])
+	d.addChunk(chunks[2])
+
+	buffer, err := d.lookup(context.Background(), h)
+	if err != nil {
+		t.Fatal("Lookup failed:", err)
+	}
+
+	if !bytes.Equal(buffer, b) {
+		t.Fatal("Inserted and looked up buffer not equal")
+	}
+
+	d.closeAndWait()
+}
+
+func TestDatabaseLookupCancel(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := d.lookup(ctx, Sum([]byte("unknown"))); err != context.DeadlineExceeded {
+		t.Fatal("Lookup not cancelled:", err)
+	}
+
+	d.closeAndWait()
+	if len(d.lookups) != 0 {
+		t.Fatal("Cancelled lookup not removed")
+	}
+}
+
+func TestDatabaseSubscribe(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := d.subscribe(ctx)
+
+	// Announce all datasets in order
+	buffers := [][]byte{[]byte("hello"), []byte("world"), []byte("works")}
+	chunks := make([]chunk, len(buffers))
+	for i, b := range buffers {
+		h, c := newTestChunks(buffers[i : i+1])
+		chunks[i] = c[0]
+		d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, len(b), false, 0, "topic", uint64(10 + i)})
+	}
+
+	// Complete them in reverse order
+	for i := len(buffers) - 1; i >= 0; i-- {
+		d.addChunk(chunks[i])
+	}
+
+	for i, b := range buffers {
+		ds := <-sub
+		if ds.Topic != "topic" || ds.Sequence != uint64(10+i) || !bytes.Equal(ds.Buffer, b) {
+			t.Fatal("Dataset delivered out of order:", ds)
+		}
+	}
+
+	// Cancelled subscriptions are closed
+	cancel()
+	if _, ok := <-sub; ok {
+		t.Fatal("Cancelled subscription not closed")
+	}
+
+	d.closeAndWait()
+}
+
+func TestDatabaseSubscribeRepeated(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+	sub := d.subscribe(context.Background())
+
+	// The same buffer is published twice by one
+	// publisher and once by another publisher
+	b := []byte("hello")
+	h, chunks := newTestChunks([][]byte{b})
+	d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, len(b), false, 1, "", 0})
+	d.addChunk(chunks[0])
+	d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, len(b), false, 1, "", 1})
+	d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, len(b), false, 2, "", 0})
+
+	expected := []streamPosition{{streamKey{1, ""}, 0}, {streamKey{1, ""}, 1}, {streamKey{2, ""}, 0}}
+	for _, pos := range expected {
+		ds := <-sub
+		if ds.Source != pos.source || ds.Sequence != pos.sequence || !bytes.Equal(ds.Buffer, b) {
+			t.Fatal("Dataset delivered at wrong position:", ds)
+		}
+	}
+
+	d.closeAndWait()
+}
+
+// Announce and complete a dataset of a single chunk
+func addTestDataset(d *database, b []byte, sequence uint64) Hash {
+	h, chunks := newTestChunks([][]byte{b})
+	d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, len(b), false, 0, "", sequence})
+	d.addChunk(chunks[0])
+	return h
+}
+
+func TestDatabaseEviction(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictLeastRecentlyUsed, EvictOldest} {
+		d := newDatabase(nil, databaseLimits{maxDatasets: 2, policy: policy}, NewMemoryStore())
+		h1 := addTestDataset(d, []byte("hello"), 0)
+		h2 := addTestDataset(d, []byte("world"), 1)
+
+		// Using the first dataset only protects it from the LRU policy
+		if _, err := d.lookup(context.Background(), h1); err != nil {
+			t.Fatal("Lookup failed:", err)
+		}
+		h3 := addTestDataset(d, []byte("works"), 2)
+
+		evicted, kept := h2, h1
+		if policy == EvictOldest {
+			evicted, kept = h1, h2
+		}
+		for _, h := range []Hash{kept, h3} {
+			if _, err := d.lookup(context.Background(), h); err != nil {
+				t.Fatal("Lookup with policy", policy, "failed:", err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if _, err := d.lookup(ctx, evicted); err != context.DeadlineExceeded {
+			t.Fatal("Dataset not evicted with policy", policy)
+		}
+		cancel()
+
+		// Two chunks and two merged buffers are left
+		d.closeAndWait()
+		if d.evicted != 1 || d.bytes != 4*len("hello") {
+			t.Fatal("Wrong eviction accounting:", d.evicted, d.bytes)
+		}
+	}
+}
+
+func TestDatabaseEvictionWaiting(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{maxDatasets: 2}, NewMemoryStore())
+	sub := d.subscribe(context.Background())
+
+	// The first dataset is never completed
+	h, _ := newTestChunks([][]byte{[]byte("hello"), []byte("world")})
+	d.addMetaData(metadata{h, 2, SHA512_256Hash, 0, 10, false, 0, "", 0})
+
+	// The second waits for the first, until it is evicted,
+	// publishing the first again protects it
+	addTestDataset(d, []byte("works"), 1)
+	d.addMetaData(metadata{h, 2, SHA512_256Hash, 0, 10, false, 0, "other", 0})
+	addTestDataset(d, []byte("again"), 2)
+
+	select {
+	case ds := <-sub:
+		t.Fatal("Dataset delivered out of order:", ds)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	d.closeAndWait()
+
+	// No merged buffer is kept beyond the capacity
+	if s := d.streams[streamKey{0, ""}]; len(s.completed) != 1 || d.bytes != 2*len("again") {
+		t.Fatal("Evicted dataset still waiting:", s.completed, d.bytes)
+	}
+}
+
+func TestDatabaseTTL(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{ttl: 50 * time.Millisecond}, NewMemoryStore())
+	sub := d.subscribe(context.Background())
+
+	// The first dataset is never completed
+	h, _ := newTestChunks([][]byte{[]byte("hello"), []byte("world")})
+	d.addMetaData(metadata{h, 2, SHA512_256Hash, 0, 10, false, 0, "", 0})
+	addTestDataset(d, []byte("works"), 1)
+
+	// The subscription skips the expired dataset
+	select {
+	case ds := <-sub:
+		if ds.Sequence != 1 {
+			t.Fatal("Wrong dataset delivered:", ds)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscription still waits for expired dataset")
+	}
+
+	// A waiting lookup keeps the dataset beyond its TTL
+	h, chunks := newTestChunks([][]byte{[]byte("again")})
+	d.addMetaData(metadata{h, 1, SHA512_256Hash, 0, 5, false, 0, "", 2})
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		d.addChunk(chunks[0])
+	}()
+
+	b, err := d.lookup(context.Background(), h)
+	if err != nil || !bytes.Equal(b, []byte("again")) {
+		t.Fatal("Lookup of pinned dataset failed:", err)
+	}
+
+	d.closeAndWait()
+}
+
+func TestDatabaseSequenceTimeout(t *testing.T) {
+	d := newDatabase(nil, databaseLimits{sequenceTimeout: 50 * time.Millisecond}, NewMemoryStore())
+	sub := d.subscribe(context.Background())
+
+	// The metadata of the second dataset never arrives
+	addTestDataset(d, []byte("hello"), 0)
+	addTestDataset(d, []byte("world"), 2)
+	addTestDataset(d, []byte("works"), 3)
+
+	// The subscription skips the missing dataset after the timeout
+	for _, sequence := range []uint64{0, 2, 3} {
+		select {
+		case ds := <-sub:
+			if ds.Sequence != sequence {
+				t.Fatal("Received sequence", ds.Sequence, "instead of", sequence)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Subscription still waits for missing dataset")
+		}
+	}
+
+	// The missing dataset is not delivered late
+	addTestDataset(d, []byte("late"), 1)
+	addTestDataset(d, []byte("again"), 4)
+	if ds := <-sub; ds.Sequence != 4 {
+		t.Fatal("Received sequence", ds.Sequence, "instead of 4")
+	}
+
+	d.closeAndWait()
+}
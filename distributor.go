@@ -1,7 +1,11 @@
 package gofoxnet
 
 import (
+	"context"
+	"crypto/ed25519"
 	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/augustoroman/multierror"
 )
@@ -10,6 +14,151 @@ import (
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 
+type DistributorOption func(*distributorOptions)
+
+type distributorOptions struct {
+	throttleOptions []ThrottleOption
+	topics          []string
+	trustedKeys     []ed25519.PublicKey
+	decryptionKeys  map[string][]byte
+	compression     Compression
+	codec           Codec
+	limits          databaseLimits
+	store           Store
+}
+
+func (o *distributorOptions) datasetStore() Store {
+	if o.store == nil {
+		return NewMemoryStore()
+	}
+	return o.store
+}
+
+// Streams skip missing datasets before the waiting ones expire
+const defaultSequenceTimeout = 5 * time.Second
+
+func (o *distributorOptions) databaseLimits() databaseLimits {
+	limits := o.limits
+	if limits.sequenceTimeout == 0 {
+		limits.sequenceTimeout = defaultSequenceTimeout
+		if limits.ttl > 0 && limits.ttl/2 < limits.sequenceTimeout {
+			limits.sequenceTimeout = limits.ttl / 2
+		}
+	}
+	return limits
+}
+
+func (o *distributorOptions) wireCodec() Codec {
+	if o.codec == nil {
+		return MsgpackCodec
+	}
+	return o.codec
+}
+
+// ThrottleDistributor throttles all peers of the distributor.
+func ThrottleDistributor(throttleOptions ...ThrottleOption) DistributorOption {
+	return func(o *distributorOptions) {
+		o.throttleOptions = append(o.throttleOptions, throttleOptions...)
+	}
+}
+
+// Topics subscribes the distributor to the given topics, by default
+// it is subscribed to all topics. Chunks of other topics are only
+// forwarded to peers, which subscribed to them, but never stored.
+func Topics(topics ...string) DistributorOption {
+	return func(o *distributorOptions) {
+		o.topics = append(o.topics, topics...)
+	}
+}
+
+// TrustedKeys only accepts buffers from publishers, which sign
+// with one of the given keys. Publishers sending anything else
+// are disconnected. By default all publishers are accepted.
+func TrustedKeys(keys ...ed25519.PublicKey) DistributorOption {
+	return func(o *distributorOptions) {
+		o.trustedKeys = append(o.trustedKeys, keys...)
+	}
+}
+
+// DecryptTopic decrypts the buffers of a topic, which the publisher
+// encrypted with EncryptTopic. Without the key, lookups of these
+// buffers fail and subscriptions do not receive them.
+func DecryptTopic(topic string, key []byte) DistributorOption {
+	return func(o *distributorOptions) {
+		if o.decryptionKeys == nil {
+			o.decryptionKeys = make(map[string][]byte)
+		}
+		o.decryptionKeys[topic] = key
+	}
+}
+
+// CompressForwarded compresses the chunks forwarded to peers,
+// which support the compression. Hashes are not affected by it.
+func CompressForwarded(compression Compression) DistributorOption {
+	return func(o *distributorOptions) {
+		o.compression = compression
+	}
+}
+
+// DistributorCodec sets the codec of all messages exchanged with
+// peers, the default is the MsgpackCodec. Publishers and other
+// distributors have to use the same codec.
+func DistributorCodec(codec Codec) DistributorOption {
+	return func(o *distributorOptions) {
+		o.codec = codec
+	}
+}
+
+// DatabaseCapacity limits the bytes of all chunks and merged buffers
+// and the number of datasets a distributor keeps, zero means unlimited.
+// Datasets with waiting lookups are never evicted.
+func DatabaseCapacity(bytes, datasets int) DistributorOption {
+	return func(o *distributorOptions) {
+		o.limits.maxBytes = bytes
+		o.limits.maxDatasets = datasets
+	}
+}
+
+// DatasetTTL evicts every dataset and every chunk without metadata
+// the given time after it arrived. Subscriptions skip datasets,
+// which were evicted before they were completed.
+func DatasetTTL(ttl time.Duration) DistributorOption {
+	return func(o *distributorOptions) {
+		o.limits.ttl = ttl
+	}
+}
+
+// SequenceTimeout is the time subscriptions wait for a missing dataset,
+// while later datasets of its publisher and topic are complete. Then the
+// missing datasets are skipped. The default is five seconds or half the
+// DatasetTTL, if that is shorter.
+func SequenceTimeout(timeout time.Duration) DistributorOption {
+	return func(o *distributorOptions) {
+		o.limits.sequenceTimeout = timeout
+	}
+}
+
+// Eviction selects the datasets, which are evicted first, if the
+// capacity is exceeded, the default is EvictLeastRecentlyUsed.
+func Eviction(policy EvictionPolicy) DistributorOption {
+	return func(o *distributorOptions) {
+		o.limits.policy = policy
+	}
+}
+
+// DistributorStore keeps the chunks and metadata of all datasets in the
+// given store, by default they are kept in memory. The datasets already
+// in the store are loaded, when the distributor is created.
+func DistributorStore(store Store) DistributorOption {
+	return func(o *distributorOptions) {
+		o.store = store
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
 type Distributor struct {
 	readWriteThrottle
 	database  *database
@@ -18,31 +167,97 @@ type Distributor struct {
 	receiver  *receiver
 }
 
-func NewDistributor(rwc io.ReadWriteCloser, throttleOptions ...ThrottleOption) *Distributor {
+// NewDistributor creates a distributor, which receives from the
+// publisher connected by rwc. If rwc is nil, publishers can be
+// added later with AddPublisherPeer.
+func NewDistributor(rwc io.ReadWriteCloser, options ...DistributorOption) *Distributor {
+	var o distributorOptions
+	for _, f := range options {
+		f(&o)
+	}
+
 	var d Distributor
-	d.readWriteThrottle.setup(throttleOptions...)
-	d.database = newDatabase()
-	d.forwarder = newForwarder()
-	d.collector = newCollector(d.database)
-	d.receiver = newReceiver(d.readWriteThrottle.throttle(rwc), d.database, d.forwarder)
+	topics := newTopicFilter(o.topics)
+	d.readWriteThrottle.setup(o.throttleOptions...)
+	d.database = newDatabase(o.decryptionKeys, o.databaseLimits(), o.datasetStore())
+	seen := newChunkSet()
+	node := newNodeId()
+	codec := o.wireCodec()
+	d.forwarder = newForwarder(node, codec, seen, o.compression)
+	d.collector = newCollector(node, codec, d.database, topics, seen)
+	d.receiver = newReceiver(node, codec, d.database, d.forwarder, topics, o.trustedKeys)
+	if rwc != nil {
+		d.AddPublisherPeer(rwc)
+	}
 	return &d
 }
 
+// AddPublisherPeer receives from another publisher. The datasets of
+// all publishers are stored in the same database and each publisher
+// can disconnect without affecting the others.
+func (d *Distributor) AddPublisherPeer(rwc io.ReadWriteCloser) {
+	d.AddPublisherPeerContext(context.Background(), rwc)
+}
+
+// AddPublisherPeerContext is like AddPublisherPeer, but stops
+// waiting for the distributor to accept the peer, if ctx is done.
+func (d *Distributor) AddPublisherPeerContext(ctx context.Context, rwc io.ReadWriteCloser) error {
+	return d.receiver.addPeer(ctx, d.readWriteThrottle.throttle(rwc))
+}
+
 func (d *Distributor) AddCollectorPeer(rwc io.ReadWriteCloser) {
-	d.collector.addPeer(d.readWriteThrottle.throttle(rwc))
+	d.AddCollectorPeerContext(context.Background(), rwc)
+}
+
+// AddCollectorPeerContext is like AddCollectorPeer, but stops
+// waiting for the distributor to accept the peer, if ctx is done.
+func (d *Distributor) AddCollectorPeerContext(ctx context.Context, rwc io.ReadWriteCloser) error {
+	return d.collector.addPeer(ctx, d.readWriteThrottle.throttle(rwc))
 }
 
 func (d *Distributor) AddForwardingPeer(rwc io.ReadWriteCloser) {
-	d.forwarder.addPeer(d.readWriteThrottle.throttle(rwc))
+	d.AddForwardingPeerContext(context.Background(), rwc)
+}
+
+// AddForwardingPeerContext is like AddForwardingPeer, but stops
+// waiting for the distributor to accept the peer, if ctx is done.
+func (d *Distributor) AddForwardingPeerContext(ctx context.Context, rwc io.ReadWriteCloser) error {
+	return d.forwarder.addPeer(ctx, d.readWriteThrottle.throttle(rwc))
+}
+
+func (d *Distributor) Lookup(hash Hash) ([]byte, error) {
+	return d.LookupContext(context.Background(), hash)
+}
+
+// LookupContext is like Lookup, but stops waiting if ctx is done.
+func (d *Distributor) LookupContext(ctx context.Context, hash Hash) ([]byte, error) {
+	return d.database.lookup(ctx, hash)
+}
+
+// Subscribe returns all datasets, which are completed from now on.
+// The datasets of each publisher and topic are delivered in the order
+// they were published, so a missing dataset holds back its successors
+// until the SequenceTimeout.
+// The channel is closed, if ctx or the distributor is done.
+func (d *Distributor) Subscribe(ctx context.Context) <-chan Dataset {
+	return d.database.subscribe(ctx)
 }
 
-func (d *Distributor) Lookup(hash string) ([]byte, error) {
-	return d.database.lookup(hash)
+// Stats returns a snapshot of the statistics of the distributor.
+func (d *Distributor) Stats() DistributorStats {
+	return DistributorStats{
+		d.receiver.traffic.snapshot(),
+		d.forwarder.traffic.snapshot(),
+		d.collector.traffic.snapshot(),
+		atomic.LoadUint64(&d.database.merged),
+		atomic.LoadUint64(&d.database.mergeFailures),
+		atomic.LoadUint64(&d.database.evicted),
+	}
 }
 
 func (d *Distributor) Close() error {
 	var errors multierror.Accumulator
-	errors.Push(d.receiver.close())
+	errors.Push(d.receiver.closeAndWait())
 	errors.Push(d.forwarder.closeAndWait())
 	errors.Push(d.collector.closeAndWait())
 	errors.Push(d.database.closeAndWait())
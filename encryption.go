@@ -0,0 +1,46 @@
+package gofoxnet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// Encrypts the buffer with AES-GCM, the random nonce is
+// prepended and the topic is authenticated as well
+func encrypt(key []byte, topic string, buffer []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(buffer)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, buffer, []byte(topic)), nil
+}
+
+func decrypt(key []byte, topic string, buffer []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buffer) < aead.NonceSize() {
+		return nil, errors.New("Encrypted buffer too short")
+	}
+
+	nonce, ciphertext := buffer[:aead.NonceSize()], buffer[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(topic))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,32 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	buffer := []byte("helloworldworks")
+
+	encrypted, err := encrypt(key, "topic", buffer)
+	if err != nil {
+		t.Fatal("Encryption failed:", err)
+	}
+	if bytes.Contains(encrypted, buffer) {
+		t.Fatal("Buffer not encrypted")
+	}
+
+	decrypted, err := decrypt(key, "topic", encrypted)
+	if err != nil {
+		t.Fatal("Decryption failed:", err)
+	}
+	if !bytes.Equal(decrypted, buffer) {
+		t.Fatal("Buffer and decrypted buffer not equal:", string(buffer), "!=", string(decrypted))
+	}
+
+	// The topic is authenticated
+	if _, err := decrypt(key, "other", encrypted); err == nil {
+		t.Fatal("Decryption for another topic succeeded")
+	}
+}
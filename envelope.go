@@ -0,0 +1,124 @@
+package gofoxnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The type of a message on the wire
+type messageType uint8
+
+const (
+	helloMessage messageType = iota + 1
+	insertionMessage
+	metaInfoMessage
+	interestMessage
+	forwardingMessage
+)
+
+// Every message is framed by its type and the length of
+// its payload, so peers skip messages they do not know
+const messageHeaderSize = 5
+
+// Larger messages are rejected instead of allocated, the
+// hello is limited further, because it comes from any peer
+const (
+	maxMessageSize = 64 << 20
+	maxHelloSize   = 64 << 10
+)
+
+// Leaves room for the metadata and the proof of a chunk
+const maxChunkSize = maxMessageSize - 1<<20
+
+// Bounds the chunks of a dataset, so metadata from
+// any peer never makes a distributor allocate more
+const maxChunkCount = 1 << 16
+
+// The hello is always encoded with the binary codec,
+// so peers with different codecs are able to tell
+func messageCodec(typ messageType, codec Codec) Codec {
+	if typ == helloMessage {
+		return BinaryCodec
+	}
+	return codec
+}
+
+// A received message, the payload is not decoded yet
+type message struct {
+	typ     messageType
+	payload []byte
+	codec   Codec
+}
+
+func (m *message) decode(v interface{}) error {
+	return messageCodec(m.typ, m.codec).Unmarshal(m.payload, v)
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type messageWriter struct {
+	io.Writer
+	codec Codec
+}
+
+func newMessageWriter(w io.Writer, codec Codec) *messageWriter {
+	return &messageWriter{w, codec}
+}
+
+func (w *messageWriter) write(typ messageType, v interface{}) error {
+	payload, err := messageCodec(typ, w.codec).Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxMessageSize {
+		return errors.New("Message too large")
+	}
+
+	// Write the frame at once, so it is never interleaved
+	frame := make([]byte, messageHeaderSize, messageHeaderSize+len(payload))
+	frame[0] = byte(typ)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err = w.Write(append(frame, payload...))
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type messageReader struct {
+	io.Reader
+	codec Codec
+
+	// The first message is the hello
+	limit uint32
+}
+
+func newMessageReader(r io.Reader, codec Codec) *messageReader {
+	return &messageReader{r, codec, maxHelloSize}
+}
+
+func (r *messageReader) read() (message, error) {
+	var header [messageHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return message{}, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > r.limit {
+		return message{}, errors.New("Message too large")
+	}
+	r.limit = maxMessageSize
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return message{}, err
+	}
+	return message{messageType(header[0]), payload, r.codec}, nil
+}
@@ -0,0 +1,55 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	var b bytes.Buffer
+	w := newMessageWriter(&b, MsgpackCodec)
+	w.write(metaInfoMessage, &distributorMetaInfo{UploadCapacity: 300})
+	w.write(forwardingMessage, &forwardingPacket{"", Sum([]byte("hashtag")), 2, SHA512_256Hash, []byte("hello"), 1, nil, NoCompression})
+
+	r := newMessageReader(&b, MsgpackCodec)
+	m, err := r.read()
+	if err != nil || m.typ != metaInfoMessage {
+		t.Fatal("Wrong first message:", m.typ, err)
+	}
+	var mi distributorMetaInfo
+	if err := m.decode(&mi); err != nil || mi.UploadCapacity != 300 {
+		t.Fatal("Wrong meta info:", mi, err)
+	}
+
+	m, err = r.read()
+	if err != nil || m.typ != forwardingMessage {
+		t.Fatal("Wrong second message:", m.typ, err)
+	}
+
+	if _, err := r.read(); err != io.EOF {
+		t.Fatal("Stream not finished:", err)
+	}
+}
+
+func TestEnvelopeTooLarge(t *testing.T) {
+	var header [messageHeaderSize]byte
+	header[0] = byte(forwardingMessage)
+	binary.BigEndian.PutUint32(header[1:], maxMessageSize+1)
+
+	r := newMessageReader(io.MultiReader(bytes.NewReader(newHello(receivingRole)), bytes.NewReader(header[:])), MsgpackCodec)
+	if _, err := r.read(); err != nil {
+		t.Fatal("Hello not accepted:", err)
+	}
+	if _, err := r.read(); err == nil {
+		t.Fatal("Too large message accepted")
+	}
+
+	// The first message is limited further
+	header[0] = byte(helloMessage)
+	binary.BigEndian.PutUint32(header[1:], maxHelloSize+1)
+	if _, err := newMessageReader(bytes.NewReader(header[:]), MsgpackCodec).read(); err == nil {
+		t.Fatal("Too large hello accepted")
+	}
+}
@@ -0,0 +1,55 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Split the buffer into data shards and append parity shards
+func encode(buffer []byte, dataShards, parityShards int) ([][]byte, error) {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	// Split would use and zero the spare capacity of the buffer
+	data := make([]byte, len(buffer))
+	copy(data, buffer)
+
+	shards, err := enc.Split(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// Reconstruct the original buffer of the given size from the shards.
+// Missing shards must be nil, at least dataShards must be present.
+// The missing shards, including parity shards, are filled in.
+func reconstruct(shards [][]byte, dataShards, size int) ([]byte, error) {
+	if dataShards < 1 || dataShards > len(shards) {
+		return nil, errors.New("Invalid number of data shards")
+	}
+
+	enc, err := reedsolomon.New(dataShards, len(shards)-dataShards)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enc.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := enc.Join(&b, shards, size); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
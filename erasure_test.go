@@ -0,0 +1,31 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestErasureCoding(t *testing.T) {
+	b := []byte("HelloHelloHelloHelloHelloHelloHello")
+	bs, err := encode(b, 3, 2)
+	if err != nil {
+		t.Fatal("Encoding failed:", err)
+	}
+
+	if len(bs) != 5 {
+		t.Fatal("Wrong number of shards")
+	}
+
+	// Drop two shards
+	bs[0] = nil
+	bs[3] = nil
+
+	r, err := reconstruct(bs, 3, len(b))
+	if err != nil {
+		t.Fatal("Reconstruction failed:", err)
+	}
+
+	if !bytes.Equal(r, b) {
+		t.Fatal("Reconstructed buffer not equal:", string(r), "!=", string(b))
+	}
+}
@@ -0,0 +1,160 @@
+package gofoxnet
+
+import (
+	"container/list"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy selects the datasets, which are evicted first,
+// if the database of a distributor exceeds its capacity.
+type EvictionPolicy int
+
+const (
+	// EvictLeastRecentlyUsed evicts the dataset, which was
+	// not announced, completed or looked up for the longest time
+	EvictLeastRecentlyUsed EvictionPolicy = iota
+
+	// EvictOldest evicts the dataset, which was announced first
+	EvictOldest
+)
+
+// Zero means unlimited
+type databaseLimits struct {
+	maxBytes        int
+	maxDatasets     int
+	ttl             time.Duration
+	sequenceTimeout time.Duration
+	policy          EvictionPolicy
+}
+
+// Chunks, which arrived before the metadata of their dataset
+type orphanChunks struct {
+	chunks  map[int]chunk
+	bytes   int
+	added   time.Time
+	element *list.Element
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+func (d *database) addDataset(ds *dataset) {
+	d.datasets[ds.hash] = ds
+	ds.age = d.datasetsByAge.PushBack(ds)
+	ds.use = d.datasetsByUse.PushBack(ds)
+}
+
+func (d *database) addOrphans(c chunk) {
+	o := &orphanChunks{map[int]chunk{c.bufferIndex: c}, len(c.buffer), time.Now(), nil}
+	o.element = d.orphansByAge.PushBack(c.hash)
+	d.chunks[c.hash] = o
+	d.bytes += len(c.buffer)
+}
+
+// Mark the dataset as used
+func (d *database) touch(ds *dataset) {
+	d.datasetsByUse.MoveToBack(ds.use)
+}
+
+// Waiting lookups keep a dataset and its orphan chunks
+func (d *database) pinned(hash Hash) bool {
+	return len(d.lookups[hash]) > 0
+}
+
+func (d *database) overCapacity() bool {
+	return (d.limits.maxBytes > 0 && d.bytes > d.limits.maxBytes) ||
+		(d.limits.maxDatasets > 0 && len(d.datasets) > d.limits.maxDatasets)
+}
+
+// Remove expired datasets and orphan chunks, the oldest come first
+func (d *database) expire(now time.Time) {
+	for e := d.datasetsByAge.Front(); e != nil; {
+		ds, next := e.Value.(*dataset), e.Next()
+		if now.Sub(ds.added) < d.limits.ttl {
+			break
+		}
+		if !d.pinned(ds.hash) {
+			d.removeDataset(ds)
+		}
+		e = next
+	}
+
+	for e := d.orphansByAge.Front(); e != nil; {
+		hash, next := e.Value.(Hash), e.Next()
+		if now.Sub(d.chunks[hash].added) < d.limits.ttl {
+			break
+		}
+		if !d.pinned(hash) {
+			d.removeOrphans(hash)
+		}
+		e = next
+	}
+}
+
+// Evict until the capacity is kept
+func (d *database) evict() {
+	for d.overCapacity() {
+		// Orphan chunks go first, they might never be completed
+		if d.limits.maxBytes > 0 && d.bytes > d.limits.maxBytes {
+			if e := d.first(d.orphansByAge); e != nil {
+				d.removeOrphans(e.Value.(Hash))
+				continue
+			}
+		}
+
+		// The dataset to evict next according to the policy
+		order := d.datasetsByUse
+		if d.limits.policy == EvictOldest {
+			order = d.datasetsByAge
+		}
+		e := d.first(order)
+		if e == nil {
+			return
+		}
+		d.removeDataset(e.Value.(*dataset))
+	}
+}
+
+// The first element, which is not pinned
+func (d *database) first(order *list.List) *list.Element {
+	for e := order.Front(); e != nil; e = e.Next() {
+		switch v := e.Value.(type) {
+		case Hash:
+			if !d.pinned(v) {
+				return e
+			}
+		case *dataset:
+			if !d.pinned(v.hash) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (d *database) removeOrphans(hash Hash) {
+	o := d.chunks[hash]
+	d.orphansByAge.Remove(o.element)
+	d.bytes -= o.bytes
+	delete(d.chunks, hash)
+}
+
+func (d *database) removeDataset(ds *dataset) {
+	d.datasetsByAge.Remove(ds.age)
+	d.datasetsByUse.Remove(ds.use)
+	d.bytes -= ds.bytes
+	delete(d.datasets, ds.hash)
+	atomic.AddUint64(&d.evicted, 1)
+	if err := d.store.Remove(ds.hash); err != nil {
+		log.Println(err)
+	}
+
+	// Subscribers stop waiting for a dataset, which will never be
+	// delivered, and do not receive it, if it waits for predecessors
+	for _, pos := range ds.positions {
+		d.deliver(d.stream(pos.streamKey).skip(pos.sequence))
+	}
+}
@@ -24,7 +24,7 @@ func throttles() []gofoxnet.ThrottleOption {
 }
 
 func main() {
-	p := gofoxnet.NewPublisher(throttles()...)
+	p := gofoxnet.NewPublisher(gofoxnet.ThrottlePublisher(throttles()...))
 
 	// Create pipes for distributors
 	id1, di1 := net.Pipe()
@@ -38,9 +38,9 @@ func main() {
 
 	// Create distributors
 	dists := []*gofoxnet.Distributor{
-		gofoxnet.NewDistributor(di1, throttles()...),
-		gofoxnet.NewDistributor(di2, throttles()...),
-		gofoxnet.NewDistributor(di3, throttles()...),
+		gofoxnet.NewDistributor(di1, gofoxnet.ThrottleDistributor(throttles()...)),
+		gofoxnet.NewDistributor(di2, gofoxnet.ThrottleDistributor(throttles()...)),
+		gofoxnet.NewDistributor(di3, gofoxnet.ThrottleDistributor(throttles()...)),
 	}
 
 	// Interconnect all peers
@@ -56,14 +56,16 @@ func main() {
 
 	// The buffer for testing
 	buffer := []byte("helloworldworks")
-	h := gofoxnet.Hash(buffer)
 
-	// Do the insertion
-	p.Publish(buffer)
+	// Do the insertion, the result holds the hash of the dataset
+	res, err := p.Publish(buffer)
+	if err != nil {
+		log.Fatal("Publish failed:", err)
+	}
 
 	// Lookup the buffer on each peer
 	for i, d := range dists {
-		b, err := d.Lookup(h)
+		b, err := d.Lookup(res.Hash)
 		if err != nil {
 			log.Fatal("Lookup of peer", i, "failed, Reason:", err)
 		}
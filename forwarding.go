@@ -2,20 +2,30 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log"
-
-	"gopkg.in/vmihailenco/msgpack.v2"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type forwardingPacket struct {
-	Hash        string
+	Topic       string
+	Hash        Hash
+	ChunkCount  int
+	Algorithm   HashAlgorithm
 	Buffer      []byte
 	BufferIndex int
+	Proof       []Hash
+	Compression Compression
 }
 
 func (p *forwardingPacket) compatible(o *forwardingPacket) bool {
-	return p.Hash == o.Hash
+	return p.Topic == o.Topic && p.Hash == o.Hash
 }
 
 func (p *forwardingPacket) equals(o *forwardingPacket) bool {
@@ -26,6 +36,82 @@ func (p *forwardingPacket) equals(o *forwardingPacket) bool {
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 
+// The chunks of this many datasets are remembered, a replica
+// arriving after its dataset was forgotten is forwarded again
+const seenDatasets = 1 << 12
+
+// The chunks a distributor has already seen, shared by
+// collector and forwarder to suppress replicated chunks
+type chunkSet struct {
+	sync.Mutex
+	keys map[Hash]map[int]bool
+
+	// The datasets in the order they were first seen
+	order []Hash
+}
+
+func newChunkSet() *chunkSet {
+	return &chunkSet{keys: make(map[Hash]map[int]bool)}
+}
+
+// Returns false, if the chunk was already seen
+func (s *chunkSet) add(hash Hash, bufferIndex int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	indices, ok := s.keys[hash]
+	if !ok {
+		// Forget the oldest dataset
+		if len(s.order) >= seenDatasets {
+			delete(s.keys, s.order[0])
+			s.order = s.order[1:]
+		}
+
+		indices = make(map[int]bool)
+		s.keys[hash] = indices
+		s.order = append(s.order, hash)
+	}
+
+	if indices[bufferIndex] {
+		return false
+	}
+	indices[bufferIndex] = true
+	return true
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Weight of the newest sample of the measured throughput
+const rateSmoothing = 0.2
+
+// Throughput in bytes per second as float64 bits, accessed atomically
+type rateMeter uint64
+
+func (r *rateMeter) measure(bytes int, elapsed time.Duration) {
+	if bytes == 0 || elapsed <= 0 {
+		return
+	}
+
+	sample := float64(bytes) / elapsed.Seconds()
+	rate := r.value()
+	if rate == 0 {
+		rate = sample
+	} else {
+		rate += rateSmoothing * (sample - rate)
+	}
+	atomic.StoreUint64((*uint64)(r), math.Float64bits(rate))
+}
+
+func (r *rateMeter) value() float64 {
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(r)))
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
 type forwardingPeerId uint64
 
 type forwarding struct {
@@ -38,6 +124,11 @@ type forwardingResult struct {
 	err error
 }
 
+type forwardingPeerInterest struct {
+	topicInterest
+	id forwardingPeerId
+}
+
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
@@ -48,43 +139,161 @@ type forwardingPeer struct {
 	// The unique id of this peer
 	id forwardingPeerId
 
+	// Checks the remote collector before any packet is sent
+	handshake *handshake
+
 	// An forwarding chan, from which we get
 	// net chunks to forward
 	forwardingChan chan forwardingPacket
 
+	// The topics the remote peer is interested in,
+	// only accessed by the forwarder
+	topics topicFilter
+
+	// Whether the handshake succeeded, chunks are queued
+	// before, only accessed by the forwarder
+	accepted     bool
+	pending      []forwardingPacket
+	pendingBytes int
+
+	// The compression negotiated with the remote peer,
+	// accessed atomically
+	compression uint32
+
+	// The throughput to the remote peer
+	rate rateMeter
+
+	// The traffic of this peer
+	traffic *trafficCounters
+
 	// The forwarder, which created us
 	forwarder *forwarder
 }
 
-func newForwardingPeer(rwc io.ReadWriteCloser, id forwardingPeerId, forwarder *forwarder) *forwardingPeer {
-	p := &forwardingPeer{rwc, id, make(chan forwardingPacket), forwarder}
+func newForwardingPeer(rwc io.ReadWriteCloser, id forwardingPeerId, handshake *handshake, traffic *trafficCounters, forwarder *forwarder) *forwardingPeer {
+	p := &forwardingPeer{&countingReadWriteCloser{rwc, traffic}, id, handshake, make(chan forwardingPacket), nil, false, nil, 0, 0, 0, traffic, forwarder}
 	go p.processOutput()
+	go p.processInput()
 	return p
 }
 
+func (p *forwardingPeer) processInput() {
+	// Kill this peer if we are done
+	defer p.forwarder.kill(p.id)
+
+	// Setup a new reader
+	reader := newMessageReader(p, p.forwarder.codec)
+
+	// The remote peer has to be a collecting distributor
+	if err := p.handshake.receive(reader, p); err != nil {
+		if err != io.EOF && err != io.ErrClosedPipe {
+			log.Println(err)
+		}
+		return
+	}
+	p.traffic.packetReceived()
+
+	for {
+		// Try to read the next message
+		m, err := reader.read()
+		if err != nil {
+			if err != io.EOF && err != io.ErrClosedPipe {
+				log.Println(err)
+				p.traffic.decodeError()
+			}
+			break
+		}
+		p.traffic.packetReceived()
+
+		// Skip message types, which we do not handle
+		if m.typ != interestMessage {
+			continue
+		}
+
+		// Try to decode topic interest
+		var ti topicInterest
+		if err := m.decode(&ti); err != nil {
+			log.Println(err)
+			p.traffic.decodeError()
+			break
+		}
+
+		// Use the compression, as soon as the remote peer supports it
+		compression := negotiate(p.forwarder.compression, ti.Compressions)
+		atomic.StoreUint32(&p.compression, uint32(compression))
+
+		// Finally update the forwarder
+		p.forwarder.updateInterest(forwardingPeerInterest{ti, p.id})
+	}
+}
+
 func (p *forwardingPeer) processOutput() {
-	// Setup a new encoder
-	encoder := msgpack.NewEncoder(p)
+	// Setup a new writer
+	writer := newMessageWriter(p, p.forwarder.codec)
+
+	// Send nothing before the remote peer is known to be compatible
+	handshakeErr := p.handshake.send(writer)
+	p.traffic.encoded(handshakeErr)
+	if handshakeErr == nil {
+		handshakeErr = p.handshake.wait()
+	}
+	if handshakeErr == nil {
+		p.forwarder.accept(p.id)
+	}
 
 	// Receive new packets to write
 	for packet := range p.forwardingChan {
-
-		// Try to encode to remote peer
-		err := encoder.Encode(&packet)
+		err := handshakeErr
+		if err == nil {
+			// Compress only on the wire, the packet is sent to other peers
+			packet.Buffer, packet.Compression = compress(Compression(atomic.LoadUint32(&p.compression)), packet.Buffer)
+
+			// Try to encode to remote peer
+			start := time.Now()
+			err = writer.write(forwardingMessage, &packet)
+			p.traffic.encoded(err)
+			if err == nil {
+				p.rate.measure(len(packet.Buffer), time.Since(start))
+			}
+		}
 
 		// We HAVE to answer for this packet
 		p.forwarder.addResult(forwardingResult{p.id, err})
 	}
 }
 
+// Bounds the chunks queued for a peer during its handshake
+const maxPendingBytes = maxMessageSize
+
+// Queue a chunk until the handshake succeeded, chunks
+// beyond the limit are dropped, so a silent peer costs little
+func (p *forwardingPeer) queue(packet forwardingPacket) {
+	if p.pendingBytes+len(packet.Buffer) > maxPendingBytes {
+		return
+	}
+	p.pending = append(p.pending, packet)
+	p.pendingBytes += len(packet.Buffer)
+}
+
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 
 type forwarder struct {
+	// Forwarding throughput and the number
+	// of waiting forwardings, accessed atomically
+	rate   rateMeter
+	queued int64
+
 	// Used to create ids
 	nextPeerId forwardingPeerId
 
+	// Identifies the distributor in handshakes
+	node uint64
+
+	// The codec of all messages
+	codec Codec
+
 	// A map storing all active peers
 	peers map[forwardingPeerId]*forwardingPeer
 
@@ -94,12 +303,30 @@ type forwarder struct {
 	// Kill requests are coming in on this channel
 	killChan chan forwardingPeerId
 
+	// Peers, which passed the handshake
+	acceptChan chan forwardingPeerId
+
+	// Topic interests received from peers
+	interestChan chan forwardingPeerInterest
+
 	// Used to forward packets
 	forwardingChan chan forwarding
 
 	// Forwarding result channel
 	resultChan chan forwardingResult
 
+	// Used to report the throughput of all peers
+	statusChan chan chan []ForwardingStatus
+
+	// The chunks already forwarded or collected
+	seen *chunkSet
+
+	// The compression to use, if the remote peer supports it
+	compression Compression
+
+	// The traffic of all peers
+	traffic *roleCounters
+
 	// Used to schedule the close of this forwarder
 	done signalChan
 
@@ -107,14 +334,24 @@ type forwarder struct {
 	closed signalChan
 }
 
-func newForwarder() *forwarder {
+func newForwarder(node uint64, codec Codec, seen *chunkSet, compression Compression) *forwarder {
 	f := &forwarder{
 		0,
+		0,
+		0,
+		node,
+		codec,
 		make(map[forwardingPeerId]*forwardingPeer),
 		make(chan io.ReadWriteCloser),
 		make(chan forwardingPeerId),
+		make(chan forwardingPeerId),
+		make(chan forwardingPeerInterest),
 		make(chan forwarding),
 		make(chan forwardingResult),
+		make(chan chan []ForwardingStatus),
+		seen,
+		compression,
+		newRoleCounters(),
 		make(signalChan),
 		make(signalChan),
 	}
@@ -125,16 +362,26 @@ func newForwarder() *forwarder {
 func (f *forwarder) removeAndClosePeer(id forwardingPeerId) {
 	if p, ok := f.peers[id]; ok {
 		delete(f.peers, id)
+		f.traffic.remove(uint64(id))
 		close(p.forwardingChan)
 		p.Close()
 	}
 }
 
 func (f *forwarder) createPeer(rwc io.ReadWriteCloser) {
-	f.peers[f.nextPeerId] = newForwardingPeer(rwc, f.nextPeerId, f)
+	h := newHandshake(f.node, forwardingRole, f.codec, nil, nil)
+	f.peers[f.nextPeerId] = newForwardingPeer(rwc, f.nextPeerId, h, f.traffic.add(uint64(f.nextPeerId)), f)
 	f.nextPeerId++
 }
 
+func (f *forwarder) updateInterest(interest forwardingPeerInterest) {
+	select {
+	case f.interestChan <- interest:
+	case <-f.done:
+		break
+	}
+}
+
 func (f *forwarder) addResult(result forwardingResult) {
 	select {
 	case f.resultChan <- result:
@@ -143,11 +390,14 @@ func (f *forwarder) addResult(result forwardingResult) {
 	}
 }
 
-func (f *forwarder) addPeer(rwc io.ReadWriteCloser) {
+func (f *forwarder) addPeer(ctx context.Context, rwc io.ReadWriteCloser) error {
 	select {
 	case f.addPeerChan <- rwc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-f.done:
-		break
+		return errors.New("Forwarder stopped while adding peer")
 	}
 }
 
@@ -159,15 +409,64 @@ func (f *forwarder) kill(id forwardingPeerId) {
 	}
 }
 
+func (f *forwarder) accept(id forwardingPeerId) {
+	select {
+	case f.acceptChan <- id:
+	case <-f.done:
+		break
+	}
+}
+
+func (f *forwarder) uploadCapacity() float64 {
+	return f.rate.value()
+}
+
+func (f *forwarder) queueDepth() int {
+	return int(atomic.LoadInt64(&f.queued))
+}
+
+func (f *forwarder) peerStatus() []ForwardingStatus {
+	status := make([]ForwardingStatus, 0, len(f.peers))
+	for id, p := range f.peers {
+		status = append(status, ForwardingStatus{uint64(id), p.rate.value()})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Peer < status[j].Peer })
+	return status
+}
+
+func (f *forwarder) status() []ForwardingStatus {
+	resChan := make(chan []ForwardingStatus, 1)
+
+	select {
+	case f.statusChan <- resChan:
+		return <-resChan
+	case <-f.done:
+		return nil
+	}
+}
+
 func (f *forwarder) processForwarding(forwarding forwarding) {
 	// Close ready channel
 	defer close(forwarding.ready)
 
 	// Collect variables necessary for forwarding
-	count := len(f.peers)
+	count := 0
+	start := time.Now()
 	var notForwarded []forwardingPeerId
 
 	for _, c := range f.peers {
+		// Only forward to interested peers
+		if !c.topics.matches(forwarding.packet.Topic) {
+			continue
+		}
+
+		// Never wait for peers with a pending handshake
+		if !c.accepted {
+			c.queue(forwarding.packet)
+			continue
+		}
+		count++
+
 		// Forward every packet,
 		// If done, return!
 		select {
@@ -195,8 +494,46 @@ func (f *forwarder) processForwarding(forwarding forwarding) {
 		}
 	}
 
+	// Update the measured throughput
+	f.rate.measure(len(forwarding.packet.Buffer)*(count-len(notForwarded)), time.Since(start))
+
+	// Failed peers are already removed, the remaining
+	// peers still get every chunk
 	if len(notForwarded) > 0 {
-		panic("Not all buffers forwarded, do more about this")
+		log.Println("Dropped forwarding peers:", notForwarded)
+	}
+}
+
+// Forward the chunks queued during the handshake of the peer
+func (f *forwarder) processAccept(id forwardingPeerId) {
+	p, ok := f.peers[id]
+	if !ok {
+		return
+	}
+
+	pending := p.pending
+	p.accepted, p.pending, p.pendingBytes = true, nil, 0
+	for _, packet := range pending {
+		if !p.topics.matches(packet.Topic) {
+			continue
+		}
+
+		select {
+		case p.forwardingChan <- packet:
+		case <-f.done:
+			return
+		}
+
+		select {
+		case res := <-f.resultChan:
+			if res.err != nil {
+				log.Println("Dropped forwarding peer:", res.id)
+				f.removeAndClosePeer(res.id)
+				return
+			}
+		case <-f.done:
+			return
+		}
 	}
 }
 
@@ -211,8 +548,16 @@ loop:
 			f.createPeer(rwc)
 		case id := <-f.killChan:
 			f.removeAndClosePeer(id)
+		case id := <-f.acceptChan:
+			f.processAccept(id)
+		case interest := <-f.interestChan:
+			if p, ok := f.peers[interest.id]; ok {
+				p.topics = newTopicFilter(interest.Topics)
+			}
 		case forwarding := <-f.forwardingChan:
 			f.processForwarding(forwarding)
+		case resChan := <-f.statusChan:
+			resChan <- f.peerStatus()
 		case <-f.done:
 			break loop
 		}
@@ -225,8 +570,17 @@ loop:
 }
 
 func (f *forwarder) forward(packet forwardingPacket) {
+	// Replicas of a chunk are forwarded only once, a chunk
+	// collected from a neighbour already reached the mesh
+	if !f.seen.add(packet.Hash, packet.BufferIndex) {
+		return
+	}
+
 	forwarding := forwarding{packet, make(signalChan)}
 
+	atomic.AddInt64(&f.queued, 1)
+	defer atomic.AddInt64(&f.queued, -1)
+
 	select {
 	case f.forwardingChan <- forwarding:
 	case <-f.done:
@@ -266,32 +620,100 @@ type collectingPeer struct {
 	// The unique id of this peer
 	id collectingPeerId
 
+	// Checks the remote forwarder before any packet is received
+	handshake *handshake
+
+	// The traffic of this peer
+	traffic *trafficCounters
+
 	// The collector, which created us
 	collector *collector
 }
 
-func newCollectingPeer(rwc io.ReadWriteCloser, id collectingPeerId, collector *collector) *collectingPeer {
-	p := &collectingPeer{rwc, id, collector}
+func newCollectingPeer(rwc io.ReadWriteCloser, id collectingPeerId, handshake *handshake, traffic *trafficCounters, collector *collector) *collectingPeer {
+	p := &collectingPeer{&countingReadWriteCloser{rwc, traffic}, id, handshake, traffic, collector}
+	go p.processOutput()
 	go p.processInput()
 	return p
 }
 
+func (p *collectingPeer) processOutput() {
+	// Setup a new writer
+	writer := newMessageWriter(p, p.collector.codec)
+
+	// Announce nothing before the remote peer is known to be compatible
+	err := p.handshake.send(writer)
+	p.traffic.encoded(err)
+	if err == nil {
+		if p.handshake.wait() != nil {
+			return
+		}
+
+		// Tell the remote forwarder, which topics we want
+		interest := p.collector.topics.interest()
+		err = writer.write(interestMessage, &interest)
+		p.traffic.encoded(err)
+	}
+	if err != nil {
+		if err != io.EOF && err != io.ErrClosedPipe {
+			log.Println(err)
+		}
+	}
+}
+
 func (p *collectingPeer) processInput() {
 	// Kill this peer if we are done
 	defer p.collector.kill(p.id)
 
-	// Setup a new decoder
-	decoder := msgpack.NewDecoder(p)
+	// Setup a new reader
+	reader := newMessageReader(p, p.collector.codec)
+
+	// The remote peer has to be a forwarding distributor
+	if err := p.handshake.receive(reader, p); err != nil {
+		if err != io.EOF && err != io.ErrClosedPipe {
+			log.Println(err)
+		}
+		return
+	}
+	p.traffic.packetReceived()
 
 	for {
-		// Try to decode forwarding packet
-		var fp forwardingPacket
-		if err := decoder.Decode(&fp); err != nil {
+		// Try to read the next message
+		m, err := reader.read()
+		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
 				log.Println(err)
+				p.traffic.decodeError()
 			}
 			break
 		}
+		p.traffic.packetReceived()
+
+		// Skip message types, which we do not handle
+		if m.typ != forwardingMessage {
+			continue
+		}
+
+		// Try to decode forwarding packet
+		var fp forwardingPacket
+		if err := m.decode(&fp); err != nil {
+			log.Println(err)
+			p.traffic.decodeError()
+			break
+		}
+
+		// Hashes are defined over the uncompressed chunk
+		if fp.Buffer, err = decompress(fp.Compression, fp.Buffer, maxMessageSize); err != nil {
+			log.Println(err)
+			break
+		}
+		fp.Compression = NoCompression
+
+		// Drop chunks, which are not part of the dataset
+		if !fp.Algorithm.verifyProof(fp.Hash, fp.Buffer, fp.BufferIndex, fp.ChunkCount, fp.Proof) {
+			log.Println("Chunk", fp.BufferIndex, "of dataset", fp.Hash, "has an invalid proof")
+			continue
+		}
 
 		// Finally push to collector
 		p.collector.collect(fp)
@@ -306,6 +728,12 @@ type collector struct {
 	// Used to create ids
 	nextPeerId collectingPeerId
 
+	// Identifies the distributor in handshakes
+	node uint64
+
+	// The codec of all messages
+	codec Codec
+
 	// A map storing all active peers
 	peers map[collectingPeerId]*collectingPeer
 
@@ -321,6 +749,15 @@ type collector struct {
 	// The database to store the packets
 	database *database
 
+	// The topics to store
+	topics topicFilter
+
+	// The chunks already forwarded or collected
+	seen *chunkSet
+
+	// The traffic of all peers
+	traffic *roleCounters
+
 	// Used to schedule the close of this forwarder
 	done signalChan
 
@@ -328,14 +765,19 @@ type collector struct {
 	closed signalChan
 }
 
-func newCollector(database *database) *collector {
+func newCollector(node uint64, codec Codec, database *database, topics topicFilter, seen *chunkSet) *collector {
 	c := &collector{
 		0,
+		node,
+		codec,
 		make(map[collectingPeerId]*collectingPeer),
 		make(chan io.ReadWriteCloser),
 		make(chan collectingPeerId),
 		make(chan forwardingPacket),
 		database,
+		topics,
+		seen,
+		newRoleCounters(),
 		make(signalChan),
 		make(signalChan),
 	}
@@ -346,20 +788,25 @@ func newCollector(database *database) *collector {
 func (c *collector) removeAndClosePeer(id collectingPeerId) {
 	if p, ok := c.peers[id]; ok {
 		delete(c.peers, id)
+		c.traffic.remove(uint64(id))
 		p.Close()
 	}
 }
 
 func (c *collector) createPeer(rwc io.ReadWriteCloser) {
-	c.peers[c.nextPeerId] = newCollectingPeer(rwc, c.nextPeerId, c)
+	h := newHandshake(c.node, collectingRole, c.codec, nil, nil)
+	c.peers[c.nextPeerId] = newCollectingPeer(rwc, c.nextPeerId, h, c.traffic.add(uint64(c.nextPeerId)), c)
 	c.nextPeerId++
 }
 
-func (c *collector) addPeer(rwc io.ReadWriteCloser) {
+func (c *collector) addPeer(ctx context.Context, rwc io.ReadWriteCloser) error {
 	select {
 	case c.addPeerChan <- rwc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-c.done:
-		break
+		return errors.New("Collector stopped while adding peer")
 	}
 }
 
@@ -391,7 +838,10 @@ loop:
 		case id := <-c.killChan:
 			c.removeAndClosePeer(id)
 		case fp := <-c.packetChan:
-			c.database.addChunk(chunk{fp.Hash, fp.Buffer, fp.BufferIndex})
+			c.seen.add(fp.Hash, fp.BufferIndex)
+			if c.topics.matches(fp.Topic) {
+				c.database.addChunk(chunk{fp.Hash, fp.Buffer, fp.BufferIndex, fp.Proof})
+			}
 		case <-c.done:
 			break loop
 		}
@@ -2,38 +2,42 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
+	"net"
 	"testing"
-
-	"gopkg.in/vmihailenco/msgpack.v2"
+	"time"
 )
 
 func TestForwarder(t *testing.T) {
-	f := newForwarder()
+	f := newForwarder(0, MsgpackCodec, newChunkSet(), NoCompression)
 
 	// Insert all peers
-	peers := []*rwcBuffer{newRWCBuffer(), newRWCBuffer(), newRWCBuffer()}
-	f.addPeer(peers[0])
-	f.addPeer(peers[1])
-	f.addPeer(peers[2])
+	peers := []*rwcBuffer{newRWCBuffer(collectingRole), newRWCBuffer(collectingRole), newRWCBuffer(collectingRole)}
+	f.addPeer(context.Background(), peers[0])
+	f.addPeer(context.Background(), peers[1])
+	f.addPeer(context.Background(), peers[2])
+
+	// Make sure the handshakes are done, so the chunk is not queued
+	time.Sleep(time.Millisecond * 100)
 
 	// The buffer for testing
-	packet := forwardingPacket{"#hashtag", []byte("HelloWorldHello"), 99}
+	packet := forwardingPacket{"", Sum([]byte("hashtag")), 100, SHA512_256Hash, []byte("HelloWorldHello"), 99, []Hash{Sum([]byte("sibling"))}, NoCompression}
 
 	// Do the forwarding
 	f.forward(packet)
 
 	// Recreate buffer
 	var resultPacket1 forwardingPacket
-	decoder := msgpack.NewDecoder(peers[0].buffer)
-	decoder.Decode(&resultPacket1)
+	reader := newPeerReader(peers[0].buffer)
+	receive(reader, &resultPacket1)
 
 	var resultPacket2 forwardingPacket
-	decoder = msgpack.NewDecoder(peers[1].buffer)
-	decoder.Decode(&resultPacket2)
+	reader = newPeerReader(peers[1].buffer)
+	receive(reader, &resultPacket2)
 
 	var resultPacket3 forwardingPacket
-	decoder = msgpack.NewDecoder(peers[2].buffer)
-	decoder.Decode(&resultPacket3)
+	reader = newPeerReader(peers[2].buffer)
+	receive(reader, &resultPacket3)
 
 	// Compare buffers
 	if !resultPacket1.equals(&resultPacket2) {
@@ -50,44 +54,84 @@ func TestForwarder(t *testing.T) {
 	}
 }
 
+func TestForwarderPendingHandshake(t *testing.T) {
+	f := newForwarder(0, MsgpackCodec, newChunkSet(), NoCompression)
+
+	// The remote peer reads, but does not answer yet
+	l, r := net.Pipe()
+	f.addPeer(context.Background(), l)
+	reader := newMessageReader(r, MsgpackCodec)
+	var h hello
+	if err := receive(reader, &h); err != nil {
+		t.Fatal("Failed to receive hello:", err)
+	}
+
+	// The forwarding does not wait for the peer
+	packet := forwardingPacket{"", Sum([]byte("hashtag")), 100, SHA512_256Hash, []byte("HelloWorldHello"), 99, []Hash{Sum([]byte("sibling"))}, NoCompression}
+	forwarded := make(signalChan)
+	go func() {
+		f.forward(packet)
+		close(forwarded)
+	}()
+	select {
+	case <-forwarded:
+	case <-time.After(time.Second):
+		t.Fatal("Forwarding blocked by pending handshake")
+	}
+
+	// The queued chunk follows the handshake
+	go newMessageWriter(r, MsgpackCodec).write(helloMessage, &hello{protocolName, protocolVersion, 42, collectingRole, "msgpack", nil})
+	var resultPacket forwardingPacket
+	if err := receive(reader, &resultPacket); err != nil || !resultPacket.equals(&packet) {
+		t.Fatal("Queued chunk not forwarded:", err)
+	}
+
+	f.closeAndWait()
+}
+
 func TestCollector(t *testing.T) {
-	d := newDatabase()
-	c := newCollector(d)
+	d := newDatabase(nil, databaseLimits{}, NewMemoryStore())
+	c := newCollector(0, MsgpackCodec, d, nil, newChunkSet())
 
 	// Fake packets and readers
 	data := []byte("helloworldworks")
-	h := Hash(data)
-	f1 := forwardingPacket{h, []byte("hello"), 0}
-	b, _ := msgpack.Marshal(f1)
-	r1 := bytes.NewReader(b)
+	h, chunks := newTestChunks([][]byte{data[:5], data[5:10], data[10:]})
+	f1 := forwardingPacket{"", h, 3, SHA512_256Hash, []byte("hello"), 0, chunks[0].proof, NoCompression}
+	r1 := bytes.NewBuffer(newHello(forwardingRole))
+	newMessageWriter(r1, MsgpackCodec).write(forwardingMessage, &f1)
 
-	f2 := forwardingPacket{h, []byte("world"), 1}
-	b, _ = msgpack.Marshal(f2)
-	r2 := bytes.NewReader(b)
+	// Unknown message types are skipped
+	f2 := forwardingPacket{"", h, 3, SHA512_256Hash, []byte("world"), 1, chunks[1].proof, NoCompression}
+	r2 := bytes.NewBuffer(newHello(forwardingRole))
+	newMessageWriter(r2, MsgpackCodec).write(messageType(99), []string{"future"})
+	newMessageWriter(r2, MsgpackCodec).write(forwardingMessage, &f2)
 
-	f3 := forwardingPacket{h, []byte("works"), 2}
-	b, _ = msgpack.Marshal(f3)
-	r3 := bytes.NewReader(b)
+	f3 := forwardingPacket{"", h, 3, SHA512_256Hash, []byte("works"), 2, chunks[2].proof, NoCompression}
+	r3 := bytes.NewBuffer(newHello(forwardingRole))
+	newMessageWriter(r3, MsgpackCodec).write(forwardingMessage, &f3)
 
 	// Register peers
-	c.addPeer(newRWC(r1))
-	c.addPeer(newRWC(r2))
-	c.addPeer(newRWC(r3))
+	c.addPeer(context.Background(), newRWC(r1))
+	c.addPeer(context.Background(), newRWC(r2))
+	c.addPeer(context.Background(), newRWC(r3))
 
 	// Make sure the packets,
 	// which are received,
 	// make any sense
 	d.addMetaData(metadata{
 		h,
-		[]string{
-			Hash([]byte("hello")),
-			Hash([]byte("world")),
-			Hash([]byte("works")),
-		},
+		3,
+		SHA512_256Hash,
+		0,
+		15,
+		false,
+		0,
+		"",
+		0,
 	})
 
 	// Wait for database lookup
-	b, err := d.lookup(h)
+	b, err := d.lookup(context.Background(), h)
 
 	if err != nil {
 		t.Fatal("Database lookup failed:", err)
@@ -103,3 +147,18 @@ func TestCollector(t *testing.T) {
 		t.Fatal("Not all peers closed")
 	}
 }
+
+func TestChunkSet(t *testing.T) {
+	s := newChunkSet()
+	if !s.add(Sum([]byte("hello")), 0) || s.add(Sum([]byte("hello")), 0) || !s.add(Sum([]byte("hello")), 1) {
+		t.Fatal("Seen chunks not suppressed")
+	}
+
+	// The oldest dataset is forgotten
+	for i := 0; i < seenDatasets; i++ {
+		s.add(Sum([]byte{byte(i), byte(i >> 8)}), 0)
+	}
+	if len(s.keys) != seenDatasets || !s.add(Sum([]byte("hello")), 0) {
+		t.Fatal("Seen datasets not bounded:", len(s.keys))
+	}
+}
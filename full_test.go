@@ -2,51 +2,461 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"net"
 	"testing"
+	"time"
 )
 
 func TestFull(t *testing.T) {
+	testFull(t, []byte("helloworldworks"))
+}
+
+func TestFullFixedSizeChunks(t *testing.T) {
+	testFull(t, []byte("helloworldworks!"), Chunking(FixedSizeChunker{4}))
+}
+
+func TestFullLessChunksThanPeers(t *testing.T) {
+	testFull(t, []byte("helloworld"), Chunking(FixedSizeChunker{8}))
+}
+
+func TestFullReplication(t *testing.T) {
+	testFull(t, []byte("helloworldworks"), Replication(2))
+}
+
+func TestFullCompressed(t *testing.T) {
+	p := NewPublisher(CompressPublished(ZstdCompression))
+	compressing := []DistributorOption{CompressForwarded(FlateCompression)}
+	dists := newMesh(p, compressing, compressing, compressing)
+
+	// Wait for all peers to announce their compressions
+	time.Sleep(100 * time.Millisecond)
+
+	buffer := bytes.Repeat([]byte("helloworldworks"), 100)
+	res, err := p.Publish(buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	for i, d := range dists {
+		b, err := d.Lookup(res.Hash)
+		if err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+
+		if !bytes.Equal(b, buffer) {
+			t.Fatal("Peer", i, "has unequal buffer content")
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
+
+func TestFullTopics(t *testing.T) {
 	p := NewPublisher()
+	dists := newMesh(p, []DistributorOption{Topics("a")}, []DistributorOption{Topics("b")}, nil)
 
-	// Create pipes for distributors
-	id1, di1 := net.Pipe()
-	id2, di2 := net.Pipe()
-	id3, di3 := net.Pipe()
+	// Wait for all topic interests
+	time.Sleep(100 * time.Millisecond)
 
-	// Add inserter peers
-	p.AddPeer(id1)
-	p.AddPeer(id2)
-	p.AddPeer(id3)
+	// The buffer for testing
+	buffer := []byte("helloworldworks")
 
-	// Create distributors
-	dists := []*Distributor{
-		NewDistributor(di1),
-		NewDistributor(di2),
-		NewDistributor(di3),
+	// Do the insertion
+	res, err := p.PublishTopic("a", buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
 	}
 
-	// Interconnect all peers
-	for _, from := range dists {
-		for _, to := range dists {
-			if from != to {
-				a, b := net.Pipe()
-				from.AddCollectorPeer(a)
-				to.AddForwardingPeer(b)
+	// Only subscribed peers have the buffer
+	for i, d := range dists {
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		b, err := d.LookupContext(ctx, res.Hash)
+		cancel()
+
+		if i == 1 {
+			if err == nil {
+				t.Fatal("Peer", i, "stored topic it is not subscribed to")
 			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+
+		if !bytes.Equal(b, buffer) {
+			t.Fatal("Peer", i, "has unequal buffer content:", string(b), "!=", string(buffer))
 		}
 	}
 
-	// The buffer for testing
+	closeMesh(t, p, dists)
+}
+
+func TestFullSubscribe(t *testing.T) {
+	p := NewPublisher(PublishWindow(4))
+	dists := newMesh(p, nil, nil, nil)
+
+	// Subscribe on every peer
+	var subs []<-chan Dataset
+	for _, d := range dists {
+		subs = append(subs, d.Subscribe(context.Background()))
+	}
+
+	// Publish concurrently
+	buffers := [][]byte{[]byte("hello"), []byte("world"), []byte("works"), []byte("again")}
+	errs := make(chan error)
+	for _, b := range buffers {
+		go func(b []byte) {
+			_, err := p.Publish(b)
+			errs <- err
+		}(b)
+	}
+
+	for range buffers {
+		if err := <-errs; err != nil {
+			t.Fatal("Publish failed:", err)
+		}
+	}
+
+	// Every peer receives all buffers in publish order
+	for i, sub := range subs {
+		for j := range buffers {
+			ds := <-sub
+			if ds.Sequence != uint64(j) {
+				t.Fatal("Peer", i, "received sequence", ds.Sequence, "instead of", j)
+			}
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
+
+func TestFullSubscribeAfterFailure(t *testing.T) {
+	p := NewPublisher(MinPeers(2, false))
+	dists := newMesh(p, nil, nil)
+	sub := dists[0].Subscribe(context.Background())
+
+	res, err := p.Publish([]byte("hello"))
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	// The distributor to drop has to forward its chunk first
+	if _, err := dists[0].Lookup(res.Hash); err != nil {
+		t.Fatal("Lookup failed:", err)
+	}
+
+	// Drop a distributor and wait for the publisher to notice
+	if err := dists[1].Close(); err != nil {
+		t.Fatal("Failed to close distributor:", err)
+	}
+	for len(p.PeerStatus()) > 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := p.Publish([]byte("world")); err == nil {
+		t.Fatal("Publish without enough peers did not fail")
+	}
+
+	// Add the distributor again
+	a, b := net.Pipe()
+	p.AddPeer(a)
+	dists[1] = NewDistributor(b)
+	for _, pair := range [][]*Distributor{{dists[0], dists[1]}, {dists[1], dists[0]}} {
+		a, b := net.Pipe()
+		pair[0].AddCollectorPeer(a)
+		pair[1].AddForwardingPeer(b)
+	}
+	if err := p.WaitForPeers(context.Background(), 2); err != nil {
+		t.Fatal("Waiting for peers failed:", err)
+	}
+
+	if _, err := p.Publish([]byte("works")); err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	// The failed publish leaves no gap in the stream
+	for j, buffer := range []string{"hello", "works"} {
+		ds := <-sub
+		if ds.Sequence != uint64(j) || string(ds.Buffer) != buffer {
+			t.Fatal("Received sequence", ds.Sequence, "instead of", j)
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
+
+func TestFullMultiplePublishers(t *testing.T) {
+	p1 := NewPublisher()
+	dists := newMesh(p1, nil, nil, nil)
+
+	// Connect a second publisher to every distributor
+	p2 := NewPublisher()
+	for _, d := range dists {
+		a, b := net.Pipe()
+		p2.AddPeer(a)
+		d.AddPublisherPeer(b)
+	}
+
+	sub := dists[0].Subscribe(context.Background())
+
+	// Both publishers start their own stream
+	buffers := [][]byte{[]byte("hello"), []byte("world")}
+	for i, p := range []*Publisher{p1, p2} {
+		if _, err := p.Publish(buffers[i]); err != nil {
+			t.Fatal("Publish of publisher", i, "failed:", err)
+		}
+	}
+
+	// Both streams start at sequence zero
+	sources := make(map[uint64]bool)
+	for range buffers {
+		ds := <-sub
+		if ds.Sequence != 0 {
+			t.Fatal("Received sequence", ds.Sequence, "instead of 0")
+		}
+		sources[ds.Source] = true
+	}
+	if len(sources) != 2 {
+		t.Fatal("Streams of both publishers not distinguished")
+	}
+
+	// The second publisher keeps working without the first
+	if err := p1.Close(); err != nil {
+		t.Fatal("Failed to close publisher:", err)
+	}
+
+	buffer := []byte("works")
+	res, err := p2.Publish(buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	for i, d := range dists {
+		b, err := d.Lookup(res.Hash)
+		if err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+
+		if !bytes.Equal(b, buffer) {
+			t.Fatal("Peer", i, "has unequal buffer content:", string(b), "!=", string(buffer))
+		}
+	}
+
+	closeMesh(t, p2, dists)
+}
+
+func TestFullTakeOver(t *testing.T) {
+	p1 := NewPublisher()
+	dists := newMesh(p1, nil, nil, nil)
+
+	// Connect a standby publisher to every distributor
+	p2 := NewPublisher(Standby(p1.Source()))
+	for _, d := range dists {
+		a, b := net.Pipe()
+		p2.AddPeer(a)
+		d.AddPublisherPeer(b)
+	}
+
+	sub := dists[0].Subscribe(context.Background())
+
+	// The standby learns the stream position from the first reports
+	for reported := false; !reported; time.Sleep(time.Millisecond) {
+		reported = true
+		for _, status := range p2.PeerStatus() {
+			reported = reported && !status.Received.IsZero()
+		}
+	}
+
+	// The first publisher fails before the last buffer
+	buffers := [][]byte{[]byte("hello"), []byte("world"), []byte("works")}
+	for i, b := range buffers {
+		if i < 2 {
+			if _, err := p1.Publish(b); err != nil {
+				t.Fatal("Publish failed:", err)
+			}
+		}
+		if _, err := p2.Publish(b); err != nil {
+			t.Fatal("Standby publish failed:", err)
+		}
+	}
+
+	if err := p1.Close(); err != nil {
+		t.Fatal("Failed to close publisher:", err)
+	}
+
+	if err := p2.TakeOver(context.Background()); err != nil {
+		t.Fatal("Take over failed:", err)
+	}
+
+	if _, err := p2.Publish([]byte("again")); err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	// The stream continues without gaps
+	for j := 0; j < 4; j++ {
+		ds := <-sub
+		if ds.Source != p1.Source() || ds.Sequence != uint64(j) {
+			t.Fatal("Received sequence", ds.Sequence, "of", ds.Source, "instead of", j)
+		}
+	}
+
+	closeMesh(t, p2, dists)
+}
+
+func TestFullSigned(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	trusted := []DistributorOption{TrustedKeys(public)}
+	p := NewPublisher(SigningKey(private))
+	dists := newMesh(p, trusted, trusted, trusted)
+
+	// Connect a publisher with an unknown key
+	untrusted := NewPublisher(SigningKey(other))
+	for _, d := range dists {
+		a, b := net.Pipe()
+		untrusted.AddPeer(a)
+		d.AddPublisherPeer(b)
+	}
+
+	forged, _ := untrusted.Publish([]byte("forgedbuffer"))
+
 	buffer := []byte("helloworldworks")
-	h := Hash(buffer)
+	res, err := p.Publish(buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	for i, d := range dists {
+		b, err := d.Lookup(res.Hash)
+		if err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+
+		if !bytes.Equal(b, buffer) {
+			t.Fatal("Peer", i, "has unequal buffer content:", string(b), "!=", string(buffer))
+		}
+
+		// The untrusted buffer was rejected
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		_, err = d.LookupContext(ctx, forged.Hash)
+		cancel()
+		if err == nil {
+			t.Fatal("Peer", i, "accepted an untrusted buffer")
+		}
+	}
+
+	untrusted.Close()
+	closeMesh(t, p, dists)
+}
+
+func TestFullEncrypted(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	p := NewPublisher(EncryptTopic("secret", key))
+	decrypting := []DistributorOption{DecryptTopic("secret", key)}
+	dists := newMesh(p, decrypting, nil, decrypting)
+
+	buffer := []byte("helloworldworks")
+	res, err := p.PublishTopic("secret", buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	// The relay in the middle forwards, but cannot decrypt
+	for i, d := range dists {
+		b, err := d.Lookup(res.Hash)
+		if i == 1 {
+			if err == nil {
+				t.Fatal("Peer", i, "decrypted without key")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+
+		if !bytes.Equal(b, buffer) {
+			t.Fatal("Peer", i, "has unequal buffer content:", string(b), "!=", string(buffer))
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
+
+func TestFullCodecs(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec, GobCodec} {
+		p := NewPublisher(PublisherCodec(codec), ErasureCoding(1))
+		coding := []DistributorOption{DistributorCodec(codec)}
+		dists := newMesh(p, coding, coding, coding)
+
+		buffer := []byte("helloworldworks")
+		res, err := p.Publish(buffer)
+		if err != nil {
+			t.Fatal("Publish with", codec.Name(), "failed:", err)
+		}
+
+		for i, d := range dists {
+			b, err := d.Lookup(res.Hash)
+			if err != nil {
+				t.Fatal("Lookup of peer", i, "with", codec.Name(), "failed, Reason:", err)
+			}
+
+			if !bytes.Equal(b, buffer) {
+				t.Fatal("Peer", i, "has unequal buffer content with", codec.Name())
+			}
+		}
+
+		closeMesh(t, p, dists)
+	}
+}
+
+func TestFullHashing(t *testing.T) {
+	for _, algorithm := range []HashAlgorithm{SHA256Hash, BLAKE2bHash} {
+		p := NewPublisher(Hashing(algorithm))
+		dists := newMesh(p, nil, nil, nil)
+
+		buffer := []byte("helloworldworks")
+		res, err := p.Publish(buffer)
+		if err != nil {
+			t.Fatal("Publish failed:", err)
+		}
+		// Every peer received one chunk, hashed with the chosen algorithm
+		if res.Hash != algorithm.MerkleRoot([][]byte{buffer[:5], buffer[5:10], buffer[10:]}) {
+			t.Fatal("Wrong hash algorithm:", res.Hash)
+		}
+
+		for i, d := range dists {
+			b, err := d.Lookup(res.Hash)
+			if err != nil {
+				t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+			}
+
+			if !bytes.Equal(b, buffer) {
+				t.Fatal("Peer", i, "has unequal buffer content")
+			}
+		}
+
+		closeMesh(t, p, dists)
+	}
+}
+
+func testFull(t *testing.T, buffer []byte, options ...PublisherOption) {
+	p := NewPublisher(options...)
+	dists := newMesh(p, nil, nil, nil)
 
 	// Do the insertion
-	p.Publish(buffer)
+	res, err := p.Publish(buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
 
 	// Lookup the buffer on each peer
 	for i, d := range dists {
-		b, err := d.Lookup(h)
+		b, err := d.Lookup(res.Hash)
 		if err != nil {
 			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
 		}
@@ -56,6 +466,39 @@ func TestFull(t *testing.T) {
 		}
 	}
 
+	closeMesh(t, p, dists)
+}
+
+// Create one distributor per options and connect them
+// to the publisher and to each other
+func newMesh(p *Publisher, options ...[]DistributorOption) []*Distributor {
+	var dists []*Distributor
+	for _, o := range options {
+		// Create pipe for distributor
+		id, di := net.Pipe()
+
+		// Add inserter peer
+		p.AddPeer(id)
+
+		// Create distributor
+		dists = append(dists, NewDistributor(di, o...))
+	}
+
+	// Interconnect all peers
+	for _, from := range dists {
+		for _, to := range dists {
+			if from != to {
+				a, b := net.Pipe()
+				from.AddCollectorPeer(a)
+				to.AddForwardingPeer(b)
+			}
+		}
+	}
+
+	return dists
+}
+
+func closeMesh(t *testing.T, p *Publisher, dists []*Distributor) {
 	if err := p.Close(); err != nil {
 		t.Fatal("Failed to close publisher:", err)
 	}
@@ -0,0 +1,179 @@
+package gofoxnet
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	protocolName    = "foxnet"
+	protocolVersion = 4
+)
+
+// Peers, which send no hello in time, are disconnected
+const handshakeTimeout = 10 * time.Second
+
+// The role of a peer on one connection
+type role uint8
+
+const (
+	insertionRole role = iota + 1
+	receivingRole
+	forwardingRole
+	collectingRole
+)
+
+func (r role) String() string {
+	switch r {
+	case insertionRole:
+		return "publisher"
+	case receivingRole:
+		return "receiving distributor"
+	case forwardingRole:
+		return "forwarding distributor"
+	case collectingRole:
+		return "collecting distributor"
+	default:
+		return fmt.Sprint("unknown role ", uint8(r))
+	}
+}
+
+// The role, which the remote peer must have
+func (r role) counterpart() role {
+	switch r {
+	case insertionRole:
+		return receivingRole
+	case receivingRole:
+		return insertionRole
+	case forwardingRole:
+		return collectingRole
+	default:
+		return forwardingRole
+	}
+}
+
+// Capabilities announced in the handshake
+const (
+	// The publisher signs its datasets
+	signedCapability = "signed"
+)
+
+// The first message on every connection, sent by both peers
+type hello struct {
+	Protocol     string
+	Version      int
+	Node         uint64
+	Role         role
+	Codec        string
+	Capabilities []string
+}
+
+func (h *hello) has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// HandshakeError is reported, if a peer is incompatible.
+type HandshakeError struct {
+	// The node id of the remote peer, zero if unknown
+	Node   uint64
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprint("Handshake with node ", e.Node, " failed: ", e.Reason)
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The handshake of one connection. The output sends the local hello
+// and waits for the input, which receives and checks the remote hello.
+type handshake struct {
+	local hello
+
+	// Additional checks of the remote hello
+	check func(remote *hello) error
+
+	// How long to wait for the remote hello
+	timeout time.Duration
+
+	// Closed, once the remote hello was checked
+	done signalChan
+	err  error
+}
+
+func newHandshake(node uint64, r role, codec Codec, capabilities []string, check func(remote *hello) error) *handshake {
+	return &handshake{hello{protocolName, protocolVersion, node, r, codec.Name(), capabilities}, check, handshakeTimeout, make(signalChan), nil}
+}
+
+func (h *handshake) send(w *messageWriter) error {
+	return w.write(helloMessage, &h.local)
+}
+
+// Receive the remote hello, the handshake fails if this fails.
+// The connection is closed, if the hello does not arrive in time.
+func (h *handshake) receive(r *messageReader, c io.Closer) error {
+	defer close(h.done)
+
+	timer := time.AfterFunc(h.timeout, func() { c.Close() })
+	m, err := r.read()
+	if !timer.Stop() {
+		h.err = &HandshakeError{0, fmt.Sprint("No hello within ", h.timeout)}
+		return h.err
+	}
+	if err != nil {
+		h.err = err
+		return err
+	}
+	if m.typ != helloMessage {
+		h.err = &HandshakeError{0, fmt.Sprint("Message type ", m.typ, " before hello")}
+		return h.err
+	}
+
+	var remote hello
+	if err := m.decode(&remote); err != nil {
+		h.err = err
+		return err
+	}
+
+	h.err = h.verify(&remote)
+	return h.err
+}
+
+func (h *handshake) verify(remote *hello) error {
+	fail := func(reason ...interface{}) error {
+		return &HandshakeError{remote.Node, fmt.Sprint(reason...)}
+	}
+
+	if remote.Protocol != protocolName {
+		return fail("Not a ", protocolName, " peer")
+	}
+	if remote.Version != protocolVersion {
+		return fail("Protocol version ", remote.Version, " instead of ", protocolVersion)
+	}
+	if expected := h.local.Role.counterpart(); remote.Role != expected {
+		return fail("Peer is a ", remote.Role, " instead of a ", expected)
+	}
+	if remote.Codec != h.local.Codec {
+		return fail("Peer uses the ", remote.Codec, " codec instead of ", h.local.Codec)
+	}
+	if h.check != nil {
+		if err := h.check(remote); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+// Wait until the remote hello was checked
+func (h *handshake) wait() error {
+	<-h.done
+	return h.err
+}
@@ -0,0 +1,76 @@
+package gofoxnet
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	r := &receiver{trustedKeys: []ed25519.PublicKey{pub}}
+	h := newHandshake(1, receivingRole, MsgpackCodec, nil, r.checkPublisher)
+
+	rejected := []hello{
+		{"other", protocolVersion, 2, insertionRole, "msgpack", []string{signedCapability}},
+		{protocolName, protocolVersion + 1, 2, insertionRole, "msgpack", []string{signedCapability}},
+		{protocolName, protocolVersion, 2, collectingRole, "msgpack", []string{signedCapability}},
+		{protocolName, protocolVersion, 2, insertionRole, "gob", []string{signedCapability}},
+		{protocolName, protocolVersion, 2, insertionRole, "msgpack", nil},
+	}
+	for _, remote := range rejected {
+		if e, ok := h.verify(&remote).(*HandshakeError); !ok || e.Node != 2 {
+			t.Fatal("Incompatible peer not rejected:", remote)
+		}
+	}
+
+	accepted := hello{protocolName, protocolVersion, 2, insertionRole, "msgpack", []string{signedCapability}}
+	if err := h.verify(&accepted); err != nil {
+		t.Fatal("Compatible peer rejected:", err)
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	l, r := net.Pipe()
+	defer r.Close()
+	i.addPeer(context.Background(), l)
+
+	reader := newMessageReader(r, MsgpackCodec)
+	var h hello
+	if err := receive(reader, &h); err != nil {
+		t.Fatal("Failed to receive hello:", err)
+	}
+	if h.Node != i.source || h.Role != insertionRole || h.Version != protocolVersion {
+		t.Fatal("Wrong hello:", h)
+	}
+
+	// Pretend to be a forwarder instead of a receiver
+	go newMessageWriter(r, MsgpackCodec).write(helloMessage, &hello{protocolName, protocolVersion, 2, forwardingRole, "msgpack", nil})
+
+	// The inserter closes the connection without sending anything
+	var packet insertionPacket
+	if err := receive(reader, &packet); err == nil {
+		t.Fatal("Incompatible peer not disconnected:", packet)
+	}
+
+	i.closeAndWait()
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	h := newHandshake(1, receivingRole, MsgpackCodec, nil, nil)
+	h.timeout = 50 * time.Millisecond
+
+	// The remote peer never sends a hello
+	l, r := net.Pipe()
+	defer r.Close()
+	if _, ok := h.receive(newMessageReader(l, MsgpackCodec), l).(*HandshakeError); !ok {
+		t.Fatal("Silent peer not rejected")
+	}
+	if _, ok := h.wait().(*HandshakeError); !ok {
+		t.Fatal("Handshake did not fail")
+	}
+}
@@ -1,30 +1,80 @@
 package gofoxnet
 
 import (
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
 )
 
-func Hash(buffer []byte) string {
-	h := sha512.Sum512(buffer)
+// HashSize is the size of every hash in bytes.
+const HashSize = 32
+
+// Hash identifies a dataset or a chunk by its content,
+// it is sent as raw bytes.
+type Hash [HashSize]byte
+
+// ParseHash parses the hex encoding of a hash.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != HashSize {
+		return h, errors.New("Hash has wrong size")
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// String returns the hex encoding of the hash.
+func (h Hash) String() string {
 	return hex.EncodeToString(h[:])
 }
 
-func SplitAndHash(buffer []byte, count int) (splitHashes []string, splitBuffers [][]byte) {
-	if count < 1 || count > len(buffer) {
-		panic("Count out of range")
-	}
+// HashAlgorithm is the algorithm used to hash datasets and chunks.
+// Distributors verify every dataset with the algorithm of its publisher.
+type HashAlgorithm uint8
+
+const (
+	SHA512_256Hash HashAlgorithm = iota
+	SHA256Hash
+	BLAKE2bHash
+)
 
-	s := len(buffer) / count
-	splitBuffers = make([][]byte, count)
-	splitHashes = make([]string, count)
+// The default algorithm, it is fast on 64 bit platforms
+const defaultHashAlgorithm = SHA512_256Hash
 
-	for i := 0; i < count; i++ {
-		b := buffer[:s]
-		splitBuffers[i] = b
-		splitHashes[i] = Hash(b)
-		buffer = buffer[s:]
+// Sum hashes the buffer.
+func (a HashAlgorithm) Sum(buffer []byte) Hash {
+	switch a {
+	case SHA256Hash:
+		return sha256.Sum256(buffer)
+	case BLAKE2bHash:
+		return blake2b.Sum256(buffer)
+	default:
+		return sha512.Sum512_256(buffer)
 	}
+}
+
+// A streaming hash of the algorithm
+func (a HashAlgorithm) new() hash.Hash {
+	switch a {
+	case SHA256Hash:
+		return sha256.New()
+	case BLAKE2bHash:
+		h, _ := blake2b.New256(nil)
+		return h
+	default:
+		return sha512.New512_256()
+	}
+}
 
-	return
+// Sum hashes the buffer with the default algorithm, SHA-512/256.
+func Sum(buffer []byte) Hash {
+	return defaultHashAlgorithm.Sum(buffer)
 }
@@ -2,20 +2,32 @@ package gofoxnet
 
 import "testing"
 
-func TestHash(t *testing.T) {
-	b := []byte("HelloHelloHelloHelloHelloHello")
-	h := Hash(b)
-	hs, bs := SplitAndHash(b, 6)
+func TestHashParse(t *testing.T) {
+	h := Sum([]byte("HelloWorld"))
+	p, err := ParseHash(h.String())
+	if err != nil || p != h {
+		t.Fatal("Hash not parsed:", p, "!=", h, err)
+	}
+
+	if _, err := ParseHash("abcd"); err == nil {
+		t.Fatal("Short hash parsed")
+	}
+	if _, err := ParseHash("not hex"); err == nil {
+		t.Fatal("Invalid hash parsed")
+	}
+}
 
-	b = b[:0]
-	for i := 0; i < 6; i++ {
-		if Hash(bs[i]) != hs[i] {
-			t.Fatal("Wrong hashes")
-		}
-		b = append(b, bs[i]...)
+func TestHashAlgorithms(t *testing.T) {
+	b := []byte("HelloWorld")
+	seen := make(map[Hash]bool)
+	for _, a := range []HashAlgorithm{SHA512_256Hash, SHA256Hash, BLAKE2bHash} {
+		seen[a.Sum(b)] = true
 	}
 
-	if Hash(b) != h {
-		t.Fatal("Wrong hash")
+	if len(seen) != 3 {
+		t.Fatal("Algorithms produced equal hashes")
+	}
+	if Sum(b) != SHA512_256Hash.Sum(b) {
+		t.Fatal("Wrong default algorithm")
 	}
 }
@@ -2,34 +2,44 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
-
-	"gopkg.in/vmihailenco/msgpack.v2"
+	"math"
+	"sync/atomic"
+	"time"
 )
 
 type insertionPacket struct {
-	Hash        string
-	SplitHashes []string
+	Source      uint64
+	Topic       string
+	Sequence    uint64
+	Hash        Hash
+	ChunkCount  int
+	Algorithm   HashAlgorithm
+	DataShards  int
+	Size        int
+	Encrypted   bool
+	Signature   []byte
 	Buffer      []byte
 	BufferIndex int
+	Proof       []Hash
+	Compression Compression
 }
 
-func (p *insertionPacket) compatible(o *insertionPacket) bool {
-	if p.Hash != o.Hash {
-		return false
-	}
+// The buffer index of packets, which only carry metadata
+const metadataOnly = -1
 
-	if len(p.SplitHashes) != len(o.SplitHashes) {
+func (p *insertionPacket) compatible(o *insertionPacket) bool {
+	if p.Source != o.Source || p.Topic != o.Topic || p.Sequence != o.Sequence || p.Hash != o.Hash || p.ChunkCount != o.ChunkCount || p.Algorithm != o.Algorithm || p.DataShards != o.DataShards || p.Size != o.Size || p.Encrypted != o.Encrypted {
 		return false
 	}
 
-	for i := 0; i < len(p.SplitHashes); i++ {
-		if p.SplitHashes[i] != o.SplitHashes[i] {
-			return false
-		}
-	}
-
 	return true
 }
 
@@ -37,29 +47,148 @@ func (p *insertionPacket) equals(o *insertionPacket) bool {
 	return p.compatible(o) && p.BufferIndex == o.BufferIndex && bytes.Equal(p.Buffer, o.Buffer)
 }
 
+// The metadata covered by the signature, the chunk itself is
+// verified with its proof against the signed Merkle root
+func (p *insertionPacket) signedMetadata() []byte {
+	var b bytes.Buffer
+	writeString := func(s string) {
+		binary.Write(&b, binary.BigEndian, uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	binary.Write(&b, binary.BigEndian, p.Source)
+	writeString(p.Topic)
+	binary.Write(&b, binary.BigEndian, p.Sequence)
+	b.Write(p.Hash[:])
+	binary.Write(&b, binary.BigEndian, int64(p.ChunkCount))
+	b.WriteByte(byte(p.Algorithm))
+	binary.Write(&b, binary.BigEndian, int64(p.DataShards))
+	binary.Write(&b, binary.BigEndian, int64(p.Size))
+	binary.Write(&b, binary.BigEndian, p.Encrypted)
+	return b.Bytes()
+}
+
+func (p *insertionPacket) sign(key ed25519.PrivateKey) []byte {
+	return ed25519.Sign(key, p.signedMetadata())
+}
+
+// Whether the packet is signed with one of the keys
+func (p *insertionPacket) verify(keys []ed25519.PublicKey) bool {
+	m := p.signedMetadata()
+	for _, k := range keys {
+		if ed25519.Verify(k, m, p.Signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reported periodically by distributors
 type distributorMetaInfo struct {
+	// Measured forwarding throughput in bytes per second
+	UploadCapacity float64
+
+	// Number of chunks waiting to be forwarded
+	QueueDepth int
+
+	// The topics stored by the distributor, empty means all
+	Topics []string
+
+	// The last sequence delivered in order of every stream
+	Completed []streamAck
+
+	// The encrypted topics the distributor has the key of
+	Decrypts []string
+
+	// The compressions the distributor is able to decompress
+	Compressions []Compression
+
+	// The state of the distributor
+	DatasetsCompleted int
+	ChunksMissing     int
+	Forwarding        []ForwardingStatus
+	MemoryInUse       uint64
+	MemoryAvailable   uint64
+
+	// Set by the receiving publisher, never sent
+	received time.Time
 }
 
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 
-type insertionPeerId uint64
-
 type insertion struct {
-	buffer []byte
-	ready  signalChan
+	ctx      context.Context
+	topic    string
+	sequence uint64
+	buffer   []byte
+	result   PublishResult
+	err      error
+	ready    signalChan
+
+	// Whether the buffer was encrypted for the topic
+	encrypted bool
+
+	// Whether the sequence was assigned already
+	numbered bool
+
+	// Set by the inserter, once the insertion is accepted
+	id          uint64
+	packets     []insertionPacket
+	outstanding chunkPeers
+	delivered   chunkPeers
+}
+
+// Maps the index of a chunk to a set of peers
+type chunkPeers map[int]map[PeerId]bool
+
+func (c chunkPeers) add(bufferIndex int, id PeerId) {
+	if c[bufferIndex] == nil {
+		c[bufferIndex] = make(map[PeerId]bool)
+	}
+	c[bufferIndex][id] = true
+}
+
+func (c chunkPeers) remove(bufferIndex int, id PeerId) bool {
+	if !c[bufferIndex][id] {
+		return false
+	}
+
+	delete(c[bufferIndex], id)
+	if len(c[bufferIndex]) == 0 {
+		delete(c, bufferIndex)
+	}
+	return true
+}
+
+type peerWaiter struct {
+	ctx   context.Context
+	count int
+	ready signalChan
+}
+
+type peerRequest struct {
+	id  PeerId
+	rwc io.ReadWriteCloser
+}
+
+// A packet queued for a peer
+type queuedPacket struct {
+	insertionId uint64
+	packet      insertionPacket
 }
 
 type insertionResult struct {
-	id          insertionPeerId
+	id          PeerId
+	insertionId uint64
 	bufferIndex int
 	err         error
 }
 
 type insertionPeerMetaInfo struct {
 	distributorMetaInfo
-	id insertionPeerId
+	id PeerId
 }
 
 //////////////////////////////////////////////////////////////////////////
@@ -70,18 +199,36 @@ type insertionPeer struct {
 	io.ReadWriteCloser
 
 	// The unique id of this peer
-	id insertionPeerId
+	id PeerId
+
+	// Checks the remote distributor before any packet is sent
+	handshake *handshake
 
 	// An insertion chan, from which we get
 	// net chunks to distribute
-	insertionChan chan insertionPacket
+	insertionChan chan queuedPacket
+
+	// The queue passes packets in order to the output
+	outputChan chan queuedPacket
+
+	// Number of queued packets without result,
+	// only accessed by the inserter
+	queued int
+
+	// The compression negotiated with the remote peer,
+	// accessed atomically
+	compression uint32
+
+	// The traffic of this peer
+	traffic *trafficCounters
 
 	// The inserter, which created us
 	inserter *inserter
 }
 
-func newInsertionPeer(rwc io.ReadWriteCloser, id insertionPeerId, inserter *inserter) *insertionPeer {
-	p := &insertionPeer{rwc, id, make(chan insertionPacket), inserter}
+func newInsertionPeer(rwc io.ReadWriteCloser, id PeerId, handshake *handshake, traffic *trafficCounters, inserter *inserter) *insertionPeer {
+	p := &insertionPeer{&countingReadWriteCloser{rwc, traffic}, id, handshake, make(chan queuedPacket), make(chan queuedPacket), 0, 0, traffic, inserter}
+	go p.processQueue()
 	go p.processOutput()
 	go p.processInput()
 	return p
@@ -91,36 +238,108 @@ func (p *insertionPeer) processInput() {
 	// Kill this peer if we are done
 	defer p.inserter.kill(p.id)
 
-	// Setup a new decoder
-	decoder := msgpack.NewDecoder(p)
+	// Setup a new reader
+	reader := newMessageReader(p, p.inserter.options.wireCodec())
+
+	// The remote peer has to be a receiving distributor
+	if err := p.handshake.receive(reader, p); err != nil {
+		if err != io.EOF && err != io.ErrClosedPipe {
+			log.Println(err)
+		}
+		return
+	}
+	p.traffic.packetReceived()
 
 	for {
-		// Try to decode meta info
-		var mi distributorMetaInfo
-		if err := decoder.Decode(&mi); err != nil {
+		// Try to read the next message
+		m, err := reader.read()
+		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
 				log.Println(err)
+				p.traffic.decodeError()
 			}
 			break
 		}
+		p.traffic.packetReceived()
+
+		// Skip message types, which we do not handle
+		if m.typ != metaInfoMessage {
+			continue
+		}
+
+		// Try to decode meta info
+		var mi distributorMetaInfo
+		if err := m.decode(&mi); err != nil {
+			log.Println(err)
+			p.traffic.decodeError()
+			break
+		}
+
+		mi.received = time.Now()
+
+		// Use the compression, as soon as the remote peer supports it
+		compression := negotiate(p.inserter.options.compression, mi.Compressions)
+		atomic.StoreUint32(&p.compression, uint32(compression))
 
 		// Finally update the inserter
 		p.inserter.updateMetaInfo(insertionPeerMetaInfo{mi, p.id})
 	}
 }
 
+// Buffers packets, so the inserter never waits for a slow peer
+func (p *insertionPeer) processQueue() {
+	defer close(p.outputChan)
+
+	var queue []queuedPacket
+	for in := p.insertionChan; in != nil || len(queue) > 0; {
+		// Only try to output, if there is something queued
+		var out chan queuedPacket
+		var next queuedPacket
+		if len(queue) > 0 {
+			out = p.outputChan
+			next = queue[0]
+		}
+
+		select {
+		case qp, ok := <-in:
+			if !ok {
+				// Queued packets are dropped, the inserter
+				// reassigns them when the peer is removed
+				return
+			}
+			queue = append(queue, qp)
+		case out <- next:
+			queue = queue[1:]
+		}
+	}
+}
+
 func (p *insertionPeer) processOutput() {
-	// Setup a new encoder
-	encoder := msgpack.NewEncoder(p)
+	// Setup a new writer
+	writer := newMessageWriter(p, p.inserter.options.wireCodec())
+
+	// Send nothing before the remote peer is known to be compatible
+	handshakeErr := p.handshake.send(writer)
+	p.traffic.encoded(handshakeErr)
+	if handshakeErr == nil {
+		handshakeErr = p.handshake.wait()
+	}
 
 	// Receive new packets to write
-	for packet := range p.insertionChan {
-
-		// Try to encode to remote peer
-		err := encoder.Encode(&packet)
+	for qp := range p.outputChan {
+		err := handshakeErr
+		if err == nil {
+			// Compress only on the wire, the packet may be sent to other peers
+			packet := qp.packet
+			packet.Buffer, packet.Compression = compress(Compression(atomic.LoadUint32(&p.compression)), packet.Buffer)
+
+			// Try to encode to remote peer
+			err = writer.write(insertionMessage, &packet)
+			p.traffic.encoded(err)
+		}
 
 		// We HAVE to answer for this packet
-		p.inserter.addResult(insertionResult{p.id, packet.BufferIndex, err})
+		p.inserter.addResult(insertionResult{p.id, qp.insertionId, qp.packet.BufferIndex, err})
 	}
 }
 
@@ -129,23 +348,71 @@ func (p *insertionPeer) processOutput() {
 //////////////////////////////////////////////////////////////////////////
 
 type inserter struct {
-	// Used to create ids
-	nextPeerId insertionPeerId
+	// Used to create ids, accessed atomically
+	nextPeerId PeerId
+
+	// Publishes, which succeeded or failed, accessed atomically
+	published       uint64
+	publishFailures uint64
+
+	// Identifies this publisher, sequence numbers are per source
+	source uint64
+
+	// Whether insertions are only retained for a take over
+	standby bool
+
+	// Used to create insertion ids
+	nextInsertionId uint64
+
+	// The next sequence number of every topic and
+	// the topics, which were numbered by this inserter
+	sequences map[string]uint64
+	numbered  map[string]bool
+
+	// The options of the publisher
+	options publisherOptions
 
 	// A map storing all active peers
-	peers map[insertionPeerId]*insertionPeer
+	peers map[PeerId]*insertionPeer
+
+	// The last meta info reported by each peer
+	metaInfos map[PeerId]distributorMetaInfo
+
+	// All insertions waiting for results
+	insertions map[uint64]*insertion
+
+	// All insertions waiting for enough peers
+	waiting []*insertion
+
+	// All callers waiting for enough peers
+	peerWaiters []peerWaiter
+
+	// Insertions retained in standby mode
+	retained []*insertion
 
 	// New peers are inserted with this channel
-	addPeerChan chan io.ReadWriteCloser
+	addPeerChan chan peerRequest
 
 	// Kill requests are coming in on this channel
-	killChan chan insertionPeerId
+	killChan chan PeerId
+
+	// Used to wait for enough peers
+	waitPeersChan chan peerWaiter
+
+	// Used to end the standby mode
+	takeOverChan chan chan []*insertion
+
+	// Used to report the status of all peers
+	statusChan chan chan []PeerStatus
+
+	// The traffic of all peers
+	traffic *roleCounters
 
 	// Meta info chan received from peers
 	metaInfoChan chan insertionPeerMetaInfo
 
 	// Used to insert bytes
-	insertionChan chan insertion
+	insertionChan chan *insertion
 
 	// Insertion result channel
 	resultChan chan insertionResult
@@ -157,14 +424,36 @@ type inserter struct {
 	closed signalChan
 }
 
-func newInserter() *inserter {
+func newInserter(options publisherOptions) *inserter {
+	source := options.source
+	if !options.standby {
+		source = newNodeId()
+	}
+
 	i := &inserter{
 		0,
-		make(map[insertionPeerId]*insertionPeer),
-		make(chan io.ReadWriteCloser),
-		make(chan insertionPeerId),
+		0,
+		0,
+		source,
+		options.standby,
+		0,
+		make(map[string]uint64),
+		make(map[string]bool),
+		options,
+		make(map[PeerId]*insertionPeer),
+		make(map[PeerId]distributorMetaInfo),
+		make(map[uint64]*insertion),
+		nil,
+		nil,
+		nil,
+		make(chan peerRequest),
+		make(chan PeerId),
+		make(chan peerWaiter),
+		make(chan chan []*insertion),
+		make(chan chan []PeerStatus),
+		newRoleCounters(),
 		make(chan insertionPeerMetaInfo),
-		make(chan insertion),
+		make(chan *insertion),
 		make(chan insertionResult),
 		make(signalChan),
 		make(signalChan),
@@ -173,17 +462,55 @@ func newInserter() *inserter {
 	return i
 }
 
-func (i *inserter) removeAndClosePeer(id insertionPeerId) {
+// Create a random node id, distributors tell the streams
+// of several publishers apart by the id of the publisher
+func newNodeId() uint64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// Outstanding chunks of a peer, which was killed or closed
+var errPeerRemoved = errors.New("Peer removed")
+
+// The chunks outstanding for the peer fail with err
+func (i *inserter) removeAndClosePeer(id PeerId, err error) {
 	if p, ok := i.peers[id]; ok {
 		delete(i.peers, id)
+		delete(i.metaInfos, id)
+		i.traffic.remove(uint64(id))
 		close(p.insertionChan)
 		p.Close()
+
+		// Reassign all chunks, which are still outstanding
+		for _, ins := range i.insertions {
+			var reassign []int
+			for bufferIndex, ids := range ins.outstanding {
+				if ids[id] {
+					reassign = append(reassign, bufferIndex)
+				}
+			}
+
+			for _, bufferIndex := range reassign {
+				ins.result.Deliveries = append(ins.result.Deliveries, Delivery{bufferIndex, id, err})
+				ins.outstanding.remove(bufferIndex, id)
+				i.reassign(ins, bufferIndex)
+			}
+			i.completeIfDone(ins)
+		}
 	}
 }
 
-func (i *inserter) createPeer(rwc io.ReadWriteCloser) {
-	i.peers[i.nextPeerId] = newInsertionPeer(rwc, i.nextPeerId, i)
-	i.nextPeerId++
+func (i *inserter) createPeer(req peerRequest) {
+	var capabilities []string
+	if i.options.signingKey != nil {
+		capabilities = append(capabilities, signedCapability)
+	}
+
+	h := newHandshake(i.source, insertionRole, i.options.wireCodec(), capabilities, nil)
+	i.peers[req.id] = newInsertionPeer(req.rwc, req.id, h, i.traffic.add(uint64(req.id)), i)
 }
 
 func (i *inserter) updateMetaInfo(metaInfo insertionPeerMetaInfo) {
@@ -202,15 +529,20 @@ func (i *inserter) addResult(result insertionResult) {
 	}
 }
 
-func (i *inserter) addPeer(rwc io.ReadWriteCloser) {
+func (i *inserter) addPeer(ctx context.Context, rwc io.ReadWriteCloser) (PeerId, error) {
+	id := PeerId(atomic.AddUint64((*uint64)(&i.nextPeerId), 1) - 1)
+
 	select {
-	case i.addPeerChan <- rwc:
+	case i.addPeerChan <- peerRequest{id, rwc}:
+		return id, nil
+	case <-ctx.Done():
+		return id, ctx.Err()
 	case <-i.done:
-		break
+		return id, errors.New("Inserter stopped while adding peer")
 	}
 }
 
-func (i *inserter) kill(id insertionPeerId) {
+func (i *inserter) kill(id PeerId) {
 	select {
 	case i.killChan <- id:
 	case <-i.done:
@@ -218,59 +550,271 @@ func (i *inserter) kill(id insertionPeerId) {
 	}
 }
 
-func (i *inserter) processInsert(ins insertion) {
-	// Close ready channel
-	defer close(ins.ready)
+// Calculate how much each peer is able to forward.
+// Peers, which did not report yet, are assumed to be average.
+func (i *inserter) weights(peers []*insertionPeer) []float64 {
+	weights := make([]float64, len(peers))
+	sum, reported := 0.0, 0
+	for j, c := range peers {
+		// The reports come from the peers, so only sane values count
+		if mi, ok := i.metaInfos[c.id]; ok && mi.UploadCapacity > 0 && !math.IsInf(mi.UploadCapacity, 1) {
+			depth := mi.QueueDepth
+			if depth < 0 {
+				depth = 0
+			}
+			weights[j] = mi.UploadCapacity / float64(1+depth)
+			sum += weights[j]
+			reported++
+		}
+	}
+
+	avg := 1.0
+	if reported > 0 {
+		avg = sum / float64(reported)
+	}
+
+	for j := range weights {
+		if weights[j] == 0 {
+			weights[j] = avg
+		}
+	}
+
+	return weights
+}
+
+// Queue the chunk for the given peer
+func (i *inserter) enqueue(ins *insertion, bufferIndex int, c *insertionPeer) {
+	ins.outstanding.add(bufferIndex, c.id)
+	c.queued++
+	c.insertionChan <- queuedPacket{ins.id, ins.packets[bufferIndex]}
+}
+
+// Queue the chunk for the least busy peer, which does not have it yet.
+// If there is none, the replica is dropped.
+func (i *inserter) reassign(ins *insertion, bufferIndex int) {
+	var target *insertionPeer
+	for _, c := range i.peers {
+		if ins.outstanding[bufferIndex][c.id] || ins.delivered[bufferIndex][c.id] {
+			continue
+		}
+		if target == nil || c.queued < target.queued {
+			target = c
+		}
+	}
+
+	if target != nil {
+		i.enqueue(ins, bufferIndex, target)
+	}
+}
+
+// Number in the order of publishing, once the chunks are queued.
+// Insertions, which fail later, leave a gap, which distributors
+// skip after their SequenceTimeout.
+func (i *inserter) number(ins *insertion) {
+	if ins.numbered {
+		return
+	}
+	ins.sequence = i.sequences[ins.topic]
+	ins.numbered = true
+	i.sequences[ins.topic]++
+	i.numbered[ins.topic] = true
+}
+
+// Notify the publisher, if no chunk is outstanding anymore
+func (i *inserter) completeIfDone(ins *insertion) {
+	if len(ins.outstanding) > 0 {
+		return
+	}
+
+	if len(ins.delivered) < len(ins.packets) {
+		ins.err = errors.New("Not all chunks delivered")
+	}
+
+	delete(i.insertions, ins.id)
+	close(ins.ready)
+}
+
+func (i *inserter) processInsert(ins *insertion) {
+	// Make sure, there are enough peers
+	if min := i.options.minPeers(); len(i.peers) < min {
+		if i.options.waitForPeers {
+			i.waiting = append(i.waiting, ins)
+			return
+		}
+
+		ins.err = &InsufficientPeersError{len(i.peers), min}
+		close(ins.ready)
+		return
+	}
 
 	// Collect variables necessary for inserting
 	buffer := ins.buffer
 	count := len(i.peers)
-	hash := Hash(buffer)
-	splitHashes, splitBuffers := SplitAndHash(buffer, count)
-	var notInserted []int
+	algorithm := i.options.hashAlgorithm
 
-	bufferIndex := 0
+	// Fix the order of peers, the n-th peer gets the n-th chunk first
+	peers := make([]*insertionPeer, 0, count)
 	for _, c := range i.peers {
-		// Create insertion packet for peer
-		p := insertionPacket{
+		peers = append(peers, c)
+	}
+
+	// Split the buffer, optionally with parity shards
+	var splitBuffers [][]byte
+	dataShards := 0
+	if i.options.parityShards > 0 {
+		dataShards = count - i.options.parityShards
+
+		var err error
+		splitBuffers, err = encode(buffer, dataShards, i.options.parityShards)
+		if err != nil {
+			ins.err = err
+			close(ins.ready)
+			return
+		}
+	} else {
+		chunker := i.options.chunker
+		if chunker == nil {
+			chunker = WeightedChunker{}
+		}
+
+		var err error
+		splitBuffers, err = split(chunker, buffer, i.weights(peers))
+		if err != nil {
+			ins.err = err
+			close(ins.ready)
+			return
+		}
+	}
+
+	// Distributors reject datasets with more chunks
+	if len(splitBuffers) > maxChunkCount {
+		ins.err = fmt.Errorf("%v chunks exceed the limit of %v chunks", len(splitBuffers), maxChunkCount)
+		close(ins.ready)
+		return
+	}
+
+	// Every chunk has to fit into a message
+	for _, b := range splitBuffers {
+		if len(b) > maxChunkSize {
+			ins.err = fmt.Errorf("Chunk of %v bytes larger than %v bytes", len(b), maxChunkSize)
+			close(ins.ready)
+			return
+		}
+	}
+
+	// The chunks are queued for sure now
+	i.number(ins)
+
+	// The dataset is identified by the Merkle root of its chunks
+	tree := newMerkleTree(algorithm, splitBuffers)
+	hash := tree.root()
+	ins.result.Hash = hash
+
+	// Create insertion packets
+	ins.id = i.nextInsertionId
+	i.nextInsertionId++
+	ins.packets = make([]insertionPacket, len(splitBuffers))
+	ins.outstanding = make(chunkPeers, len(splitBuffers))
+	ins.delivered = make(chunkPeers, len(splitBuffers))
+	for bufferIndex := range splitBuffers {
+		ins.packets[bufferIndex] = insertionPacket{
+			i.source,
+			ins.topic,
+			ins.sequence,
 			hash,
-			splitHashes,
+			len(splitBuffers),
+			algorithm,
+			dataShards,
+			len(buffer),
+			ins.encrypted,
+			nil,
 			splitBuffers[bufferIndex],
 			bufferIndex,
+			tree.proof(bufferIndex),
+			NoCompression,
 		}
+	}
 
-		// Insert every packet,
-		// If done, return!
-		select {
-		case c.insertionChan <- p:
-		case <-i.done:
-			log.Println("Inserter closed while inserting")
-			return
+	// All packets carry the same metadata
+	if key := i.options.signingKey; key != nil {
+		signature := ins.packets[0].sign(key)
+		for bufferIndex := range ins.packets {
+			ins.packets[bufferIndex].Signature = signature
 		}
+	}
 
-		bufferIndex++
+	// Queue the chunks for the peers in turn, every replica
+	// for another peer, all peers process their queues in parallel
+	i.insertions[ins.id] = ins
+	replicas := i.options.replicas(len(peers))
+	for bufferIndex := range ins.packets {
+		for r := 0; r < replicas; r++ {
+			i.enqueue(ins, bufferIndex, peers[(bufferIndex+r)%len(peers)])
+		}
 	}
 
-	// Register failed buffers
-	for j := 0; j < count; j++ {
-		select {
-		case res := <-i.resultChan:
-			if res.err != nil {
-				// Remember failed chunks
-				notInserted = append(notInserted, res.bufferIndex)
+	// Peers without a chunk still need the metadata
+	for j := len(ins.packets) + replicas - 1; j < len(peers); j++ {
+		p := ins.packets[0]
+		p.Buffer, p.BufferIndex, p.Proof = nil, metadataOnly, nil
+		peers[j].queued++
+		peers[j].insertionChan <- queuedPacket{ins.id, p}
+	}
+	i.completeIfDone(ins)
+}
 
-				// We can safely remove and close the peer here
-				i.removeAndClosePeer(res.id)
-			}
-		case <-i.done:
-			log.Println("Inserter closed while waiting for results")
-			return
+// Insert all waiting insertions, if there are enough peers now
+func (i *inserter) processWaiting() {
+	waiting := i.waiting
+	i.waiting = nil
+	for _, ins := range waiting {
+		if err := ins.ctx.Err(); err != nil {
+			ins.err = err
+			close(ins.ready)
+			continue
+		}
+		i.processInsert(ins)
+	}
+}
+
+// Notify all callers waiting for the current number of peers
+func (i *inserter) notifyPeerWaiters() {
+	waiters := i.peerWaiters[:0]
+	for _, w := range i.peerWaiters {
+		if len(i.peers) >= w.count {
+			close(w.ready)
+		} else if w.ctx.Err() == nil {
+			waiters = append(waiters, w)
 		}
 	}
+	i.peerWaiters = waiters
+}
+
+func (i *inserter) processResult(res insertionResult) {
+	if c, ok := i.peers[res.id]; ok {
+		c.queued--
+	}
+
+	// Ignore results for reassigned chunks
+	ins, ok := i.insertions[res.insertionId]
+	if !ok {
+		return
+	}
+	if !ins.outstanding[res.bufferIndex][res.id] {
+		return
+	}
 
-	if len(notInserted) > 0 {
-		panic("Not all buffers inserted, do more about this")
+	if res.err != nil {
+		// We can safely remove and close the peer here, this also
+		// fails and reassigns all outstanding chunks of the peer
+		i.removeAndClosePeer(res.id, res.err)
+		return
 	}
+
+	ins.result.Deliveries = append(ins.result.Deliveries, Delivery{res.bufferIndex, res.id, nil})
+	ins.outstanding.remove(res.bufferIndex, res.id)
+	ins.delivered.add(res.bufferIndex, res.id)
+	i.completeIfDone(ins)
 }
 
 func (i *inserter) serve() {
@@ -279,38 +823,122 @@ func (i *inserter) serve() {
 	// Select for adding, killing and inserting
 loop:
 	for {
+		// Only accept new insertions, if the window is not full
+		var insertionChan chan *insertion
+		if len(i.insertions)+len(i.waiting) < i.options.window() {
+			insertionChan = i.insertionChan
+		}
+
 		select {
-		case rwc := <-i.addPeerChan:
-			i.createPeer(rwc)
+		case req := <-i.addPeerChan:
+			i.createPeer(req)
+			i.notifyPeerWaiters()
+			i.processWaiting()
+		case w := <-i.waitPeersChan:
+			i.peerWaiters = append(i.peerWaiters, w)
+			i.notifyPeerWaiters()
 		case id := <-i.killChan:
-			i.removeAndClosePeer(id)
+			i.removeAndClosePeer(id, errPeerRemoved)
 		case info := <-i.metaInfoChan:
-			log.Println(info)
-		case insertion := <-i.insertionChan:
-			i.processInsert(insertion)
+			if _, ok := i.peers[info.id]; ok {
+				i.metaInfos[info.id] = info.distributorMetaInfo
+				if i.standby {
+					i.continueStream(info.distributorMetaInfo)
+				}
+				i.pruneRetained()
+			}
+		case insertion := <-insertionChan:
+			if i.standby {
+				i.retain(insertion)
+			} else {
+				i.processInsert(insertion)
+			}
+		case resChan := <-i.takeOverChan:
+			resChan <- i.processTakeOver()
+		case resChan := <-i.statusChan:
+			resChan <- i.peerStatus()
+		case res := <-i.resultChan:
+			i.processResult(res)
 		case <-i.done:
 			break loop
 		}
 	}
 
+	// Fail all outstanding insertions
+	for id, ins := range i.insertions {
+		delete(i.insertions, id)
+		ins.err = errors.New("Inserter closed while waiting for results")
+		close(ins.ready)
+	}
+	for _, ins := range i.waiting {
+		ins.err = errors.New("Inserter closed while waiting for peers")
+		close(ins.ready)
+	}
+	i.waiting = nil
+
 	// Remove and close all peers
 	for id := range i.peers {
-		i.removeAndClosePeer(id)
+		i.removeAndClosePeer(id, errPeerRemoved)
 	}
 }
 
-func (i *inserter) insert(buffer []byte) {
-	ins := insertion{buffer, make(signalChan)}
+func (i *inserter) insert(ctx context.Context, topic string, buffer []byte) (res PublishResult, err error) {
+	defer func() {
+		if err != nil {
+			atomic.AddUint64(&i.publishFailures, 1)
+		} else {
+			atomic.AddUint64(&i.published, 1)
+		}
+	}()
 
+	ins := &insertion{ctx: ctx, topic: topic, buffer: buffer, ready: make(signalChan)}
+
+	// Encrypt before splitting, so relays only see the ciphertext
+	if key, ok := i.options.encryptionKeys[topic]; ok {
+		if ins.buffer, err = encrypt(key, topic, buffer); err != nil {
+			return PublishResult{}, err
+		}
+		ins.encrypted = true
+	}
+
+	// Try to request insertion
 	select {
 	case i.insertionChan <- ins:
+	case <-ctx.Done():
+		return PublishResult{}, ctx.Err()
 	case <-i.done:
-		break
+		return PublishResult{}, errors.New("Inserter stopped while requesting insertion")
 	}
 
+	// Wait for the insertion to complete,
+	// the ready channel is closed in any case
 	select {
 	case <-ins.ready:
+		return ins.result, ins.err
+	case <-ctx.Done():
+		return PublishResult{}, ctx.Err()
+	}
+}
+
+func (i *inserter) waitForPeers(ctx context.Context, count int) error {
+	w := peerWaiter{ctx, count, make(signalChan)}
+
+	// Try to request waiting
+	select {
+	case i.waitPeersChan <- w:
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-i.done:
+		return errors.New("Inserter stopped while requesting to wait for peers")
+	}
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.done:
+		return errors.New("Inserter stopped while waiting for peers")
 	}
 }
 
@@ -329,42 +957,298 @@ func (i *inserter) closeAndWait() error {
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
 
-type receiver struct {
-	rwc       io.ReadWriteCloser
-	database  *database
-	forwarder *forwarder
+// How often distributors report their meta info
+const metaInfoInterval = time.Second
+
+type receivingPeerId uint64
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type receivingPeer struct {
+	io.ReadWriteCloser
+
+	// The unique id of this peer
+	id receivingPeerId
+
+	// Checks the remote publisher before any packet is received
+	handshake *handshake
+
+	// Closed, if the publisher stopped sending
+	done signalChan
+
+	// The traffic of this peer
+	traffic *trafficCounters
+
+	// The receiver, which created us
+	receiver *receiver
 }
 
-func newReceiver(rwc io.ReadWriteCloser, database *database, forwarder *forwarder) *receiver {
-	r := &receiver{rwc, database, forwarder}
-	go r.processInput()
-	return r
+func newReceivingPeer(rwc io.ReadWriteCloser, id receivingPeerId, handshake *handshake, traffic *trafficCounters, receiver *receiver) *receivingPeer {
+	p := &receivingPeer{&countingReadWriteCloser{rwc, traffic}, id, handshake, make(signalChan), traffic, receiver}
+	go p.processInput()
+	go p.processOutput()
+	return p
 }
 
-func (r *receiver) processInput() {
-	defer r.close()
+func (p *receivingPeer) processInput() {
+	// Kill this peer if we are done
+	defer p.receiver.kill(p.id)
+	defer close(p.done)
 
-	// Setup a new decoder
-	decoder := msgpack.NewDecoder(r.rwc)
+	// Setup a new reader
+	reader := newMessageReader(p, p.receiver.codec)
+
+	// The remote peer has to be a publisher
+	if err := p.handshake.receive(reader, p); err != nil {
+		if err != io.EOF && err != io.ErrClosedPipe {
+			log.Println(err)
+		}
+		return
+	}
+	p.traffic.packetReceived()
 
 	for {
 
-		// Try to decode insertion packet
-		var ip insertionPacket
-		if err := decoder.Decode(&ip); err != nil {
+		// Try to read the next message
+		m, err := reader.read()
+		if err != nil {
 			if err != io.EOF && err != io.ErrClosedPipe {
 				log.Println(err)
+				p.traffic.decodeError()
 			}
 			break
 		}
+		p.traffic.packetReceived()
+
+		// Skip message types, which we do not handle
+		if m.typ != insertionMessage {
+			continue
+		}
+
+		// Try to decode insertion packet
+		var ip insertionPacket
+		if err := m.decode(&ip); err != nil {
+			log.Println(err)
+			p.traffic.decodeError()
+			break
+		}
+
+		// Disconnect publishers, which are not trusted
+		r := p.receiver
+		if len(r.trustedKeys) > 0 && !ip.verify(r.trustedKeys) {
+			log.Println("Insertion packet without trusted signature")
+			break
+		}
+
+		// The metadata decides what the database allocates
+		md := metadata{ip.Hash, ip.ChunkCount, ip.Algorithm, ip.DataShards, ip.Size, ip.Encrypted, ip.Source, ip.Topic, ip.Sequence}
+		if err := md.validate(); err != nil {
+			log.Println(err)
+			break
+		}
+
+		// Hashes are defined over the uncompressed chunk
+		if ip.Buffer, err = decompress(ip.Compression, ip.Buffer, ip.Size); err != nil {
+			log.Println(err)
+			break
+		}
+		ip.Compression = NoCompression
+
+		// Insert meta data and chunk into database,
+		// if we are interested in the topic
+		if r.topics.matches(ip.Topic) {
+			r.database.addMetaData(md)
+		}
+
+		// There is no chunk, if the dataset has less chunks than peers
+		if ip.BufferIndex == metadataOnly {
+			continue
+		}
+
+		// Never store or forward a chunk, which is not part of the dataset
+		if !ip.Algorithm.verifyProof(ip.Hash, ip.Buffer, ip.BufferIndex, ip.ChunkCount, ip.Proof) {
+			log.Println("Chunk", ip.BufferIndex, "of dataset", ip.Hash, "has an invalid proof")
+			continue
+		}
+
+		if r.topics.matches(ip.Topic) {
+			r.database.addChunk(chunk{ip.Hash, ip.Buffer, ip.BufferIndex, ip.Proof})
+		}
+
+		// Other peers might be interested anyway
+		r.forwarder.forward(forwardingPacket{ip.Topic, ip.Hash, ip.ChunkCount, ip.Algorithm, ip.Buffer, ip.BufferIndex, ip.Proof, NoCompression})
+	}
+}
+
+func (p *receivingPeer) processOutput() {
+	// Setup a new writer
+	writer := newMessageWriter(p, p.receiver.codec)
+
+	// Report nothing before the remote peer is known to be compatible
+	err := p.handshake.send(writer)
+	p.traffic.encoded(err)
+	if err != nil || p.handshake.wait() != nil {
+		return
+	}
+
+	ticker := time.NewTicker(metaInfoInterval)
+	defer ticker.Stop()
+
+	// Report right away, so the publisher knows the compressions
+	for {
+		// Report what we are able to forward
+		mi := p.receiver.metaInfo()
+		err := writer.write(metaInfoMessage, &mi)
+		p.traffic.encoded(err)
+		if err != nil {
+			return
+		}
 
-		// Insert meta data and chunk into database
-		r.database.addMetaData(metadata{ip.Hash, ip.SplitHashes})
-		r.database.addChunk(chunk{ip.Hash, ip.Buffer, ip.BufferIndex})
-		r.forwarder.forward(forwardingPacket{ip.Hash, ip.Buffer, ip.BufferIndex})
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type receiver struct {
+	// Used to create ids
+	nextPeerId receivingPeerId
+
+	// Identifies the distributor in handshakes
+	node uint64
+
+	// The codec of all messages
+	codec Codec
+
+	// A map storing all active publisher peers
+	peers map[receivingPeerId]*receivingPeer
+
+	// New peers are inserted with this channel
+	addPeerChan chan io.ReadWriteCloser
+
+	// Kill requests are coming in on this channel
+	killChan chan receivingPeerId
+
+	// The database to store the packets
+	database *database
+
+	// Used to forward the received chunks
+	forwarder *forwarder
+
+	// The topics to store
+	topics topicFilter
+
+	// Publishers have to sign with one of these keys, if any
+	trustedKeys []ed25519.PublicKey
+
+	// The traffic of all peers
+	traffic *roleCounters
+
+	// Used to schedule the close of this receiver
+	done signalChan
+
+	// Notified if closed
+	closed signalChan
+}
+
+func newReceiver(node uint64, codec Codec, database *database, forwarder *forwarder, topics topicFilter, trustedKeys []ed25519.PublicKey) *receiver {
+	r := &receiver{
+		0,
+		node,
+		codec,
+		make(map[receivingPeerId]*receivingPeer),
+		make(chan io.ReadWriteCloser),
+		make(chan receivingPeerId),
+		database,
+		forwarder,
+		topics,
+		trustedKeys,
+		newRoleCounters(),
+		make(signalChan),
+		make(signalChan),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *receiver) removeAndClosePeer(id receivingPeerId) {
+	if p, ok := r.peers[id]; ok {
+		delete(r.peers, id)
+		r.traffic.remove(uint64(id))
+		p.Close()
+	}
+}
+
+func (r *receiver) createPeer(rwc io.ReadWriteCloser) {
+	h := newHandshake(r.node, receivingRole, r.codec, nil, r.checkPublisher)
+	r.peers[r.nextPeerId] = newReceivingPeer(rwc, r.nextPeerId, h, r.traffic.add(uint64(r.nextPeerId)), r)
+	r.nextPeerId++
+}
+
+// Publishers have to sign, if we only trust some keys
+func (r *receiver) checkPublisher(remote *hello) error {
+	if len(r.trustedKeys) > 0 && !remote.has(signedCapability) {
+		return errors.New("Publisher does not sign its datasets")
+	}
+	return nil
+}
+
+func (r *receiver) addPeer(ctx context.Context, rwc io.ReadWriteCloser) error {
+	select {
+	case r.addPeerChan <- rwc:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.done:
+		return errors.New("Receiver stopped while adding peer")
+	}
+}
+
+func (r *receiver) kill(id receivingPeerId) {
+	select {
+	case r.killChan <- id:
+	case <-r.done:
+		break
+	}
+}
+
+func (r *receiver) serve() {
+	defer close(r.closed)
+
+	// Select for adding and killing
+loop:
+	for {
+		select {
+		case rwc := <-r.addPeerChan:
+			r.createPeer(rwc)
+		case id := <-r.killChan:
+			r.removeAndClosePeer(id)
+		case <-r.done:
+			break loop
+		}
+	}
+
+	// Remove and close all peers
+	for id := range r.peers {
+		r.removeAndClosePeer(id)
 	}
 }
 
 func (r *receiver) close() error {
-	return r.rwc.Close()
+	close(r.done)
+	return nil
+}
+
+func (r *receiver) closeAndWait() error {
+	err := r.close()
+	<-r.closed
+	return err
 }
@@ -2,45 +2,46 @@ package gofoxnet
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
-
-	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 func TestInserter(t *testing.T) {
-	i := newInserter()
+	i := newInserter(publisherOptions{})
 
 	// Insert all peers
-	peers := []*rwcBuffer{newRWCBuffer(), newRWCBuffer(), newRWCBuffer()}
-	i.addPeer(peers[0])
-	i.addPeer(peers[1])
-	i.addPeer(peers[2])
+	peers := []*rwcBuffer{newRWCBuffer(receivingRole), newRWCBuffer(receivingRole), newRWCBuffer(receivingRole)}
+	i.addPeer(context.Background(), peers[0])
+	i.addPeer(context.Background(), peers[1])
+	i.addPeer(context.Background(), peers[2])
 
 	// The buffer for testing
 	buffer := []byte("HelloWorldHello")
 
 	// Do the insertion
-	i.insert(buffer)
+	i.insert(context.Background(), "", buffer)
 
 	// Recreate buffer
 	resultBuffer := make([]byte, 15)
 	var packet, packet2 insertionPacket
 
-	decoder := msgpack.NewDecoder(peers[0].buffer)
-	decoder.Decode(&packet)
+	reader := newPeerReader(peers[0].buffer)
+	receive(reader, &packet)
 	copy(resultBuffer[packet.BufferIndex*5:packet.BufferIndex*5+5], packet.Buffer)
 
-	decoder = msgpack.NewDecoder(peers[1].buffer)
-	decoder.Decode(&packet2)
+	reader = newPeerReader(peers[1].buffer)
+	receive(reader, &packet2)
 	if !packet.compatible(&packet2) {
 		t.Fatal("Packet 1 and 2 not compatible:", packet, "!=", packet2)
 	}
 	copy(resultBuffer[packet2.BufferIndex*5:packet2.BufferIndex*5+5], packet2.Buffer)
 
-	decoder = msgpack.NewDecoder(peers[2].buffer)
-	decoder.Decode(&packet)
+	reader = newPeerReader(peers[2].buffer)
+	receive(reader, &packet)
 	if !packet2.compatible(&packet) {
 		t.Fatal("Packet 2 and 3 not compatible:", packet2, "!=", packet)
 	}
@@ -58,8 +59,394 @@ func TestInserter(t *testing.T) {
 	}
 }
 
+func TestInserterFailedPeer(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	// The second peer is not writable
+	r, w := io.Pipe()
+	defer w.Close()
+	peer := newRWCBuffer(receivingRole)
+	i.addPeer(context.Background(), peer)
+	failed, _ := i.addPeer(context.Background(), newRWC(r))
+
+	// Do the insertion
+	buffer := []byte("HelloWorld")
+	res, err := i.insert(context.Background(), "", buffer)
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	f := res.Failed()
+	if len(f) != 1 || f[0].Peer != failed {
+		t.Fatal("Failed delivery not reported:", f)
+	}
+
+	if m := res.Missing(); len(m) != 0 {
+		t.Fatal("Chunks missing:", m)
+	}
+
+	// The surviving peer must have received both chunks
+	resultBuffer := make([]byte, 10)
+	reader := newPeerReader(peer.buffer)
+	for j := 0; j < 2; j++ {
+		var packet insertionPacket
+		receive(reader, &packet)
+		copy(resultBuffer[packet.BufferIndex*5:packet.BufferIndex*5+5], packet.Buffer)
+	}
+
+	if !bytes.Equal(buffer, resultBuffer) {
+		t.Fatal("Buffer and result buffer not equal:", string(buffer), "!=", string(resultBuffer))
+	}
+
+	i.closeAndWait()
+}
+
+// Accepts the hello, then blocks all writes until closed.
+// Reads return the remote hello and EOF, once fail is closed.
+type stalledPeer struct {
+	hello   io.Reader
+	fail    signalChan
+	writing signalChan
+	closed  signalChan
+	writes  int
+}
+
+func (p *stalledPeer) Read(buffer []byte) (int, error) {
+	if n, _ := p.hello.Read(buffer); n > 0 {
+		return n, nil
+	}
+	<-p.fail
+	return 0, io.EOF
+}
+
+func (p *stalledPeer) Write(buffer []byte) (int, error) {
+	if p.writes++; p.writes == 1 {
+		return len(buffer), nil
+	}
+	if p.writes == 2 {
+		close(p.writing)
+	}
+	<-p.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (p *stalledPeer) Close() error {
+	select {
+	case <-p.closed:
+	default:
+		close(p.closed)
+	}
+	return nil
+}
+
+func TestInserterKilledPeer(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	// The peer fails to read while a chunk is outstanding
+	peer := &stalledPeer{bytes.NewReader(newHello(receivingRole)), make(signalChan), make(signalChan), make(signalChan), 0}
+	id, _ := i.addPeer(context.Background(), peer)
+
+	type result struct {
+		res PublishResult
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		res, err := i.insert(context.Background(), "", []byte("HelloWorld"))
+		results <- result{res, err}
+	}()
+
+	<-peer.writing
+	close(peer.fail)
+
+	// The dropped chunk has to be reported
+	r := <-results
+	if r.err == nil {
+		t.Fatal("Insertion without delivered chunks did not fail")
+	}
+	if f := r.res.Failed(); len(f) != 1 || f[0].Peer != id {
+		t.Fatal("Failed delivery not reported:", f)
+	}
+	if m := r.res.Missing(); len(m) != 1 || m[0] != 0 {
+		t.Fatal("Missing chunks not reported:", m)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterAllPeersFailed(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	// No peer is writable
+	r, w := io.Pipe()
+	defer w.Close()
+	i.addPeer(context.Background(), newRWC(r))
+	i.addPeer(context.Background(), newRWC(r))
+
+	// Do the insertion
+	res, err := i.insert(context.Background(), "", []byte("HelloWorld"))
+	if err == nil {
+		t.Fatal("Insertion without writable peers did not fail")
+	}
+
+	if m := res.Missing(); len(m) != 2 {
+		t.Fatal("Missing chunks not reported:", m)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterReplication(t *testing.T) {
+	i := newInserter(publisherOptions{replication: 2})
+
+	// Insert all peers
+	peers := []*rwcBuffer{newRWCBuffer(receivingRole), newRWCBuffer(receivingRole), newRWCBuffer(receivingRole)}
+	for _, peer := range peers {
+		i.addPeer(context.Background(), peer)
+	}
+
+	// Do the insertion
+	res, err := i.insert(context.Background(), "", []byte("HelloWorldHello"))
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	if len(res.Deliveries) != 6 {
+		t.Fatal("Not every chunk delivered twice:", res.Deliveries)
+	}
+
+	// Every peer holds two distinct chunks
+	counts := make(map[int]int)
+	for j, peer := range peers {
+		reader := newPeerReader(peer.buffer)
+		var packet, packet2 insertionPacket
+		receive(reader, &packet)
+		receive(reader, &packet2)
+		if packet.BufferIndex == packet2.BufferIndex {
+			t.Fatal("Peer", j, "received chunk", packet.BufferIndex, "twice")
+		}
+		counts[packet.BufferIndex]++
+		counts[packet2.BufferIndex]++
+	}
+
+	for bufferIndex := 0; bufferIndex < 3; bufferIndex++ {
+		if counts[bufferIndex] != 2 {
+			t.Fatal("Chunk", bufferIndex, "has", counts[bufferIndex], "replicas")
+		}
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterWeighted(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	// Create pipes for io
+	l1, r1 := net.Pipe()
+	l2, r2 := net.Pipe()
+	i.addPeer(context.Background(), l1)
+	i.addPeer(context.Background(), l2)
+
+	// The first peer forwards three times faster
+	writer1, reader1 := remoteHandshake(t, r1, receivingRole)
+	writer1.write(metaInfoMessage, &distributorMetaInfo{UploadCapacity: 300})
+	writer2, reader2 := remoteHandshake(t, r2, receivingRole)
+	writer2.write(metaInfoMessage, &distributorMetaInfo{UploadCapacity: 100})
+
+	// Make sure the meta info was processed
+	time.Sleep(time.Millisecond * 100)
+
+	// Read the packets concurrently
+	sizes := make(chan int, 2)
+	for _, r := range []*messageReader{reader1, reader2} {
+		go func(r *messageReader) {
+			var packet insertionPacket
+			receive(r, &packet)
+			sizes <- len(packet.Buffer)
+		}(r)
+	}
+
+	// Do the insertion
+	if _, err := i.insert(context.Background(), "", []byte("HelloWorldHelloWorldHelloWorldHelloWorld")); err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	if a, b := <-sizes, <-sizes; a+b != 40 || (a != 30 && b != 30) {
+		t.Fatal("Chunk sizes not weighted:", a, b)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterWeightedInvalid(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	l1, r1 := net.Pipe()
+	l2, r2 := net.Pipe()
+	i.addPeer(context.Background(), l1)
+	i.addPeer(context.Background(), l2)
+
+	// Negative queue depths count as empty queues
+	writer1, reader1 := remoteHandshake(t, r1, receivingRole)
+	writer1.write(metaInfoMessage, &distributorMetaInfo{UploadCapacity: 300, QueueDepth: -3})
+	writer2, reader2 := remoteHandshake(t, r2, receivingRole)
+	writer2.write(metaInfoMessage, &distributorMetaInfo{UploadCapacity: 100, QueueDepth: -1})
+	time.Sleep(time.Millisecond * 100)
+
+	sizes := make(chan int, 2)
+	for _, r := range []*messageReader{reader1, reader2} {
+		go func(r *messageReader) {
+			var packet insertionPacket
+			receive(r, &packet)
+			sizes <- len(packet.Buffer)
+		}(r)
+	}
+
+	if _, err := i.insert(context.Background(), "", []byte("HelloWorldHelloWorldHelloWorldHelloWorld")); err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	if a, b := <-sizes, <-sizes; a+b != 40 || (a != 30 && b != 30) {
+		t.Fatal("Chunk sizes not weighted:", a, b)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterWindow(t *testing.T) {
+	i := newInserter(publisherOptions{windowSize: 4})
+
+	// Insert all peers
+	peers := []*rwcBuffer{newRWCBuffer(receivingRole), newRWCBuffer(receivingRole)}
+	i.addPeer(context.Background(), peers[0])
+	i.addPeer(context.Background(), peers[1])
+
+	// Insert concurrently
+	errs := make(chan error)
+	for j := 0; j < 8; j++ {
+		go func(j int) {
+			_, err := i.insert(context.Background(), "", []byte(fmt.Sprint("HelloWorld", j)))
+			errs <- err
+		}(j)
+	}
+
+	for j := 0; j < 8; j++ {
+		if err := <-errs; err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+
+	// Every peer has one chunk of every buffer
+	i.closeAndWait()
+	for _, peer := range peers {
+		reader := newPeerReader(peer.buffer)
+		hashes := make(map[Hash]bool)
+		for j := 0; j < 8; j++ {
+			var packet insertionPacket
+			if err := receive(reader, &packet); err != nil {
+				t.Fatal("Decoding failed:", err)
+			}
+			hashes[packet.Hash] = true
+		}
+
+		if len(hashes) != 8 {
+			t.Fatal("Peer received duplicate chunks")
+		}
+	}
+}
+
+func TestInserterCancel(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	// Nobody reads from this peer
+	l, r := net.Pipe()
+	defer r.Close()
+	i.addPeer(context.Background(), l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := i.insert(ctx, "", []byte("HelloWorld")); err != context.DeadlineExceeded {
+		t.Fatal("Insertion not cancelled:", err)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterNoPeers(t *testing.T) {
+	i := newInserter(publisherOptions{})
+
+	_, err := i.insert(context.Background(), "", []byte("HelloWorld"))
+	if e, ok := err.(*InsufficientPeersError); !ok || e.Peers != 0 || e.MinPeers != 1 {
+		t.Fatal("Insertion without peers did not fail properly:", err)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterInvalidChunker(t *testing.T) {
+	i := newInserter(publisherOptions{chunker: FixedSizeChunker{0}})
+	i.addPeer(context.Background(), newRWCBuffer(receivingRole))
+
+	// The inserter keeps working after a failure
+	for j := 0; j < 2; j++ {
+		if _, err := i.insert(context.Background(), "", []byte("HelloWorld")); err == nil {
+			t.Fatal("Insertion with invalid chunker did not fail")
+		}
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterChunkTooLarge(t *testing.T) {
+	i := newInserter(publisherOptions{})
+	i.addPeer(context.Background(), newRWCBuffer(receivingRole))
+
+	if _, err := i.insert(context.Background(), "", make([]byte, maxChunkSize+1)); err == nil {
+		t.Fatal("Insertion of a chunk larger than a message did not fail")
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterWaitForPeers(t *testing.T) {
+	i := newInserter(publisherOptions{minPeerCount: 2, waitForPeers: true})
+
+	// Wait for peers concurrently
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- i.waitForPeers(context.Background(), 2)
+	}()
+
+	insertErr := make(chan error)
+	go func() {
+		_, err := i.insert(context.Background(), "", []byte("HelloWorld"))
+		insertErr <- err
+	}()
+
+	// Nothing must complete with one peer
+	i.addPeer(context.Background(), newRWCBuffer(receivingRole))
+	select {
+	case <-waitErr:
+		t.Fatal("Waiting for peers completed too early")
+	case <-insertErr:
+		t.Fatal("Insertion completed too early")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	i.addPeer(context.Background(), newRWCBuffer(receivingRole))
+	if err := <-waitErr; err != nil {
+		t.Fatal("Waiting for peers failed:", err)
+	}
+	if err := <-insertErr; err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	i.closeAndWait()
+}
+
 func TestReceiver(t *testing.T) {
-	i := newInserter()
+	i := newInserter(publisherOptions{})
 
 	// Create pipes for io
 	l1, r1 := net.Pipe()
@@ -67,20 +454,23 @@ func TestReceiver(t *testing.T) {
 	l3, r3 := net.Pipe()
 
 	// Create receivers
-	rcv1 := newReceiver(r1, newDatabase(), newForwarder())
-	rcv2 := newReceiver(r2, newDatabase(), newForwarder())
-	rcv3 := newReceiver(r3, newDatabase(), newForwarder())
+	rcv1 := newReceiver(0, MsgpackCodec, newDatabase(nil, databaseLimits{}, NewMemoryStore()), newForwarder(0, MsgpackCodec, newChunkSet(), NoCompression), nil, nil)
+	rcv2 := newReceiver(0, MsgpackCodec, newDatabase(nil, databaseLimits{}, NewMemoryStore()), newForwarder(0, MsgpackCodec, newChunkSet(), NoCompression), nil, nil)
+	rcv3 := newReceiver(0, MsgpackCodec, newDatabase(nil, databaseLimits{}, NewMemoryStore()), newForwarder(0, MsgpackCodec, newChunkSet(), NoCompression), nil, nil)
+	rcv1.addPeer(context.Background(), r1)
+	rcv2.addPeer(context.Background(), r2)
+	rcv3.addPeer(context.Background(), r3)
 
 	// Add all peers
-	i.addPeer(l1)
-	i.addPeer(l2)
-	i.addPeer(l3)
+	i.addPeer(context.Background(), l1)
+	i.addPeer(context.Background(), l2)
+	i.addPeer(context.Background(), l3)
 
 	// The buffer for testing
 	buffer := []byte("helloworldworks")
 
 	// Do the insertion
-	i.insert(buffer)
+	i.insert(context.Background(), "", buffer)
 
 	// Make sure each goroutine has read
 	time.Sleep(time.Millisecond * 100)
@@ -90,7 +480,10 @@ func TestReceiver(t *testing.T) {
 		t.Fatal("Not all peers closed")
 	}
 
-	rcv1.close()
-	rcv2.close()
-	rcv3.close()
+	rcv1.closeAndWait()
+	rcv2.closeAndWait()
+	rcv3.closeAndWait()
+	if len(rcv1.peers) != 0 {
+		t.Fatal("Not all receiving peers closed")
+	}
 }
@@ -0,0 +1,122 @@
+package gofoxnet
+
+import "encoding/binary"
+
+// Leaves, inner nodes and the root are hashed with different
+// prefixes, so an inner node never passes as a chunk
+const (
+	merkleLeafPrefix = 0
+	merkleNodePrefix = 1
+	merkleRootPrefix = 2
+)
+
+func (a HashAlgorithm) sumParts(prefix byte, parts ...[]byte) Hash {
+	h := a.new()
+	h.Write([]byte{prefix})
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	var sum Hash
+	h.Sum(sum[:0])
+	return sum
+}
+
+func (a HashAlgorithm) leafHash(chunk []byte) Hash {
+	return a.sumParts(merkleLeafPrefix, chunk)
+}
+
+func (a HashAlgorithm) nodeHash(left, right Hash) Hash {
+	return a.sumParts(merkleNodePrefix, left[:], right[:])
+}
+
+// The root commits to the number of chunks, otherwise
+// an inner node would pass as a leaf of a larger tree
+func (a HashAlgorithm) rootHash(count int, top Hash) Hash {
+	var c [8]byte
+	binary.BigEndian.PutUint64(c[:], uint64(count))
+	return a.sumParts(merkleRootPrefix, c[:], top[:])
+}
+
+// MerkleRoot returns the hash, which identifies a dataset
+// published as the given chunks.
+func (a HashAlgorithm) MerkleRoot(chunks [][]byte) Hash {
+	return newMerkleTree(a, chunks).root()
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Every level pairs the nodes of the level below,
+// the last node of an odd level is moved up as it is
+type merkleTree struct {
+	algorithm HashAlgorithm
+	levels    [][]Hash
+}
+
+func newMerkleTree(algorithm HashAlgorithm, chunks [][]byte) *merkleTree {
+	level := make([]Hash, len(chunks))
+	for i, c := range chunks {
+		level[i] = algorithm.leafHash(c)
+	}
+
+	t := &merkleTree{algorithm, [][]Hash{level}}
+	for len(level) > 1 {
+		next := make([]Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, algorithm.nodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+func (t *merkleTree) root() Hash {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		return t.algorithm.rootHash(0, Hash{})
+	}
+	return t.algorithm.rootHash(len(t.levels[0]), top[0])
+}
+
+// The siblings on the path from the chunk to the root
+func (t *merkleTree) proof(index int) []Hash {
+	var proof []Hash
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// Whether the chunk is the index-th of count chunks of the dataset
+func (a HashAlgorithm) verifyProof(root Hash, chunk []byte, index, count int, proof []Hash) bool {
+	if index < 0 || index >= count {
+		return false
+	}
+
+	h := a.leafHash(chunk)
+	for n := count; n > 1; n = (n + 1) / 2 {
+		if index%2 == 1 {
+			if len(proof) == 0 {
+				return false
+			}
+			h, proof = a.nodeHash(proof[0], h), proof[1:]
+		} else if index+1 < n {
+			if len(proof) == 0 {
+				return false
+			}
+			h, proof = a.nodeHash(h, proof[0]), proof[1:]
+		}
+		index /= 2
+	}
+	return len(proof) == 0 && a.rootHash(count, h) == root
+}
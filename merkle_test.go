@@ -0,0 +1,45 @@
+package gofoxnet
+
+import "testing"
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count < 10; count++ {
+		chunks := make([][]byte, count)
+		for i := range chunks {
+			chunks[i] = []byte{byte(i)}
+		}
+
+		tree := newMerkleTree(SHA512_256Hash, chunks)
+		root := tree.root()
+		for i, c := range chunks {
+			proof := tree.proof(i)
+			if !SHA512_256Hash.verifyProof(root, c, i, count, proof) {
+				t.Fatal("Proof of chunk", i, "of", count, "rejected")
+			}
+
+			// Chunks are bound to their index and the chunk count
+			if SHA512_256Hash.verifyProof(root, []byte("tampered"), i, count, proof) {
+				t.Fatal("Tampered chunk", i, "of", count, "accepted")
+			}
+			if count > 1 && SHA512_256Hash.verifyProof(root, c, (i+1)%count, count, proof) {
+				t.Fatal("Chunk", i, "of", count, "accepted at wrong index")
+			}
+			if SHA512_256Hash.verifyProof(root, c, i, count+1, proof) {
+				t.Fatal("Chunk", i, "of", count, "accepted with wrong count")
+			}
+		}
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	chunks := [][]byte{[]byte("hello"), []byte("world")}
+	root := SHA512_256Hash.MerkleRoot(chunks)
+
+	// A leaf never passes as inner node or as another algorithm
+	if root == SHA512_256Hash.MerkleRoot([][]byte{[]byte("helloworld")}) {
+		t.Fatal("Roots of different splits are equal")
+	}
+	if root == BLAKE2bHash.MerkleRoot(chunks) {
+		t.Fatal("Roots of different algorithms are equal")
+	}
+}
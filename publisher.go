@@ -1,6 +1,254 @@
 package gofoxnet
 
-import "io"
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// PeerId identifies a peer added to a publisher.
+type PeerId uint64
+
+// Delivery describes the outcome of sending
+// one chunk to one peer.
+type Delivery struct {
+	BufferIndex int
+	Peer        PeerId
+	Err         error
+}
+
+// PublishResult lists what was delivered to which peer.
+type PublishResult struct {
+	// The Merkle root of the chunks, it depends on how the
+	// buffer was split and is zero for retained insertions
+	Hash       Hash
+	Deliveries []Delivery
+}
+
+// Failed returns all deliveries, which did not succeed.
+// Chunks of failed deliveries are reassigned to other peers,
+// so a failed delivery does not imply a missing chunk.
+func (r *PublishResult) Failed() []Delivery {
+	var failed []Delivery
+	for _, d := range r.Deliveries {
+		if d.Err != nil {
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
+
+// Missing returns the indices of all chunks,
+// which were not delivered to any peer.
+func (r *PublishResult) Missing() []int {
+	delivered := make(map[int]bool)
+	for _, d := range r.Deliveries {
+		if d.Err == nil {
+			delivered[d.BufferIndex] = true
+		} else if _, ok := delivered[d.BufferIndex]; !ok {
+			delivered[d.BufferIndex] = false
+		}
+	}
+
+	var missing []int
+	for bufferIndex, ok := range delivered {
+		if !ok {
+			missing = append(missing, bufferIndex)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type PublisherOption func(*publisherOptions)
+
+type publisherOptions struct {
+	throttleOptions []ThrottleOption
+	parityShards    int
+	chunker         Chunker
+	windowSize      int
+	minPeerCount    int
+	waitForPeers    bool
+	replication     int
+	standby         bool
+	source          uint64
+	signingKey      ed25519.PrivateKey
+	encryptionKeys  map[string][]byte
+	compression     Compression
+	codec           Codec
+	hashAlgorithm   HashAlgorithm
+}
+
+// The number of distinct peers every chunk is sent to
+func (o *publisherOptions) replicas(peers int) int {
+	r := o.replication
+	if r < 1 {
+		r = 1
+	}
+	if r > peers {
+		r = peers
+	}
+	return r
+}
+
+func (o *publisherOptions) minPeers() int {
+	// Erasure coding needs at least one data shard
+	min := o.parityShards + 1
+	if o.minPeerCount > min {
+		min = o.minPeerCount
+	}
+	return min
+}
+
+func (o *publisherOptions) wireCodec() Codec {
+	if o.codec == nil {
+		return MsgpackCodec
+	}
+	return o.codec
+}
+
+func (o *publisherOptions) window() int {
+	if o.windowSize < 1 {
+		return 1
+	}
+	return o.windowSize
+}
+
+// ThrottlePublisher throttles all peers of the publisher.
+func ThrottlePublisher(throttleOptions ...ThrottleOption) PublisherOption {
+	return func(o *publisherOptions) {
+		o.throttleOptions = append(o.throttleOptions, throttleOptions...)
+	}
+}
+
+// ErasureCoding adds the given number of parity shards to
+// every published buffer. Distributors are able to reconstruct
+// the buffer as soon as all but parityShards chunks arrived.
+// The number of peers must exceed the number of parity shards.
+func ErasureCoding(parityShards int) PublisherOption {
+	return func(o *publisherOptions) {
+		o.parityShards = parityShards
+	}
+}
+
+// Chunking sets the chunker used to split published buffers,
+// the default is the WeightedChunker. It is ignored if
+// erasure coding is enabled, because shards are equally sized.
+// Publishes with chunks of more than 63 MiB fail.
+func Chunking(chunker Chunker) PublisherOption {
+	return func(o *publisherOptions) {
+		o.chunker = chunker
+	}
+}
+
+// PublishWindow sets how many published buffers may be in flight
+// at once, the default is one. Concurrent calls to Publish beyond
+// the window wait until one of the buffers in flight completes.
+func PublishWindow(size int) PublisherOption {
+	return func(o *publisherOptions) {
+		o.windowSize = size
+	}
+}
+
+// Replication sends every chunk to the given number of distinct
+// peers, so a single slow or failing peer does not hold back the
+// chunk. It is limited by the number of peers, the default is one.
+func Replication(replicas int) PublisherOption {
+	return func(o *publisherOptions) {
+		o.replication = replicas
+	}
+}
+
+// Standby makes the publisher a hot standby for the publisher with
+// the given source id. It must be connected to the same distributors
+// and be given the same publishes, but it only keeps the buffers
+// until all distributors completed them. Relays without the key of
+// an encrypted topic are not waited for. Publishes continue after
+// the datasets the distributors reported as completed first, so a
+// standby may start late. TakeOver continues the stream of the
+// failed publisher.
+func Standby(source uint64) PublisherOption {
+	return func(o *publisherOptions) {
+		o.standby = true
+		o.source = source
+	}
+}
+
+// SigningKey signs the metadata of every published buffer, so
+// distributors configured with TrustedKeys accept it.
+func SigningKey(key ed25519.PrivateKey) PublisherOption {
+	return func(o *publisherOptions) {
+		o.signingKey = key
+	}
+}
+
+// EncryptTopic encrypts all buffers published to the topic with
+// AES-GCM, the key must have 16, 24 or 32 bytes. Only distributors
+// configured with DecryptTopic are able to read them, all others
+// still forward and verify the encrypted chunks. The hash of
+// a publish result is the hash of the encrypted buffer.
+func EncryptTopic(topic string, key []byte) PublisherOption {
+	return func(o *publisherOptions) {
+		if o.encryptionKeys == nil {
+			o.encryptionKeys = make(map[string][]byte)
+		}
+		o.encryptionKeys[topic] = key
+	}
+}
+
+// CompressPublished compresses the chunks sent to peers, which
+// support the compression. Hashes are not affected by it.
+func CompressPublished(compression Compression) PublisherOption {
+	return func(o *publisherOptions) {
+		o.compression = compression
+	}
+}
+
+// PublisherCodec sets the codec of all messages exchanged with
+// peers, the default is the MsgpackCodec. Distributors have to
+// use the same codec, peers with another codec are rejected.
+func PublisherCodec(codec Codec) PublisherOption {
+	return func(o *publisherOptions) {
+		o.codec = codec
+	}
+}
+
+// Hashing sets the algorithm used to hash published buffers and
+// their chunks, the default is SHA512_256Hash. The hash of a publish
+// result, which is used for lookups, is computed with it as well.
+func Hashing(algorithm HashAlgorithm) PublisherOption {
+	return func(o *publisherOptions) {
+		o.hashAlgorithm = algorithm
+	}
+}
+
+// MinPeers sets the number of peers necessary to publish, the
+// default is one. If wait is true, publishes wait until enough
+// peers were added, otherwise they fail with an *InsufficientPeersError.
+func MinPeers(count int, wait bool) PublisherOption {
+	return func(o *publisherOptions) {
+		o.minPeerCount = count
+		o.waitForPeers = wait
+	}
+}
+
+// InsufficientPeersError is returned, if a publish
+// fails because not enough peers were added.
+type InsufficientPeersError struct {
+	Peers    int
+	MinPeers int
+}
+
+func (e *InsufficientPeersError) Error() string {
+	return fmt.Sprint("Not enough peers to publish, ", e.Peers, " of ", e.MinPeers)
+}
 
 //////////////////////////////////////////////////////////////////////////
 //////////////////////////////////////////////////////////////////////////
@@ -11,22 +259,87 @@ type Publisher struct {
 	inserter *inserter
 }
 
-func NewPublisher(throttleOptions ...ThrottleOption) *Publisher {
-	p := &Publisher{inserter: newInserter()}
-	p.readWriteThrottle.setup(throttleOptions...)
+func NewPublisher(options ...PublisherOption) *Publisher {
+	var o publisherOptions
+	for _, f := range options {
+		f(&o)
+	}
+
+	p := &Publisher{inserter: newInserter(o)}
+	p.readWriteThrottle.setup(o.throttleOptions...)
 	return p
 }
 
+// Source returns the id, which distributors use to
+// tell the streams of several publishers apart.
+func (p *Publisher) Source() uint64 {
+	return p.inserter.source
+}
+
+// Stats returns a snapshot of the statistics of the publisher.
+func (p *Publisher) Stats() PublisherStats {
+	i := p.inserter
+	return PublisherStats{i.traffic.snapshot(), atomic.LoadUint64(&i.published), atomic.LoadUint64(&i.publishFailures)}
+}
+
+// PeerStatus returns the last status reported by every peer.
+func (p *Publisher) PeerStatus() []PeerStatus {
+	return p.inserter.status()
+}
+
+// TakeOver ends the standby mode. The sequence numbers continue
+// after the last one completed by any distributor and all buffers,
+// which are incomplete on at least one distributor, are published
+// again. It waits for these publishes, but it is a no-op if the
+// publisher is not in standby mode.
+func (p *Publisher) TakeOver(ctx context.Context) error {
+	return p.inserter.takeOver(ctx)
+}
+
 func (p *Publisher) Close() error {
 	err := p.inserter.closeAndWait()
 	p.readWriteThrottle.done()
 	return err
 }
 
-func (p *Publisher) AddPeer(rwc io.ReadWriteCloser) {
-	p.inserter.addPeer(p.readWriteThrottle.throttle(rwc))
+func (p *Publisher) AddPeer(rwc io.ReadWriteCloser) PeerId {
+	id, _ := p.AddPeerContext(context.Background(), rwc)
+	return id
+}
+
+// AddPeerContext is like AddPeer, but stops waiting for
+// the publisher to accept the peer, if ctx is done.
+func (p *Publisher) AddPeerContext(ctx context.Context, rwc io.ReadWriteCloser) (PeerId, error) {
+	return p.inserter.addPeer(ctx, p.readWriteThrottle.throttle(rwc))
+}
+
+// WaitForPeers waits until at least count peers were added.
+func (p *Publisher) WaitForPeers(ctx context.Context, count int) error {
+	return p.inserter.waitForPeers(ctx, count)
+}
+
+// Publish splits the buffer and sends the chunks to all peers.
+// It is safe to publish concurrently, see PublishWindow.
+// Chunks of failing peers are sent to the remaining peers.
+// An error is returned, if the publisher was closed or if not
+// every chunk was delivered. The result tells which were.
+func (p *Publisher) Publish(buffer []byte) (PublishResult, error) {
+	return p.PublishContext(context.Background(), buffer)
+}
+
+// PublishContext is like Publish, but stops waiting if ctx is done.
+// Chunks, which were already queued, are still sent.
+func (p *Publisher) PublishContext(ctx context.Context, buffer []byte) (PublishResult, error) {
+	return p.PublishTopicContext(ctx, "", buffer)
+}
+
+// PublishTopic is like Publish, but publishes to the given topic.
+// Only distributors subscribed to the topic store the buffer.
+func (p *Publisher) PublishTopic(topic string, buffer []byte) (PublishResult, error) {
+	return p.PublishTopicContext(context.Background(), topic, buffer)
 }
 
-func (p *Publisher) Publish(buffer []byte) {
-	p.inserter.insert(buffer)
+// PublishTopicContext is like PublishTopic, but stops waiting if ctx is done.
+func (p *Publisher) PublishTopicContext(ctx context.Context, topic string, buffer []byte) (PublishResult, error) {
+	return p.inserter.insert(ctx, topic, buffer)
 }
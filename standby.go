@@ -0,0 +1,156 @@
+package gofoxnet
+
+import (
+	"context"
+	"errors"
+
+	"github.com/augustoroman/multierror"
+)
+
+// Reported by distributors, so a standby publisher
+// knows which datasets are complete everywhere
+type streamAck struct {
+	Source   uint64
+	Topic    string
+	Sequence uint64
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Keep the insertion for a take over and report success,
+// the hash is only known once the buffer is split
+func (i *inserter) retain(ins *insertion) {
+	// The stream position is only known, once a distributor reported
+	if len(i.metaInfos) > 0 {
+		i.number(ins)
+	}
+	i.retained = append(i.retained, ins)
+	close(ins.ready)
+	i.pruneRetained()
+}
+
+// Number after the last sequences the distributor completed, so
+// a standby, which starts late, continues the stream in place
+func (i *inserter) continueStream(mi distributorMetaInfo) {
+	for _, a := range mi.Completed {
+		if a.Source == i.source && !i.numbered[a.Topic] && a.Sequence >= i.sequences[a.Topic] {
+			i.sequences[a.Topic] = a.Sequence + 1
+		}
+	}
+
+	for _, ins := range i.retained {
+		i.number(ins)
+	}
+}
+
+// Whether the distributor is able to complete encrypted datasets of the topic
+func (mi *distributorMetaInfo) decrypts(topic string) bool {
+	for _, t := range mi.Decrypts {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// The last sequence of the topic, which the peer completed
+func (i *inserter) lastCompleted(mi distributorMetaInfo, topic string) (uint64, bool) {
+	for _, a := range mi.Completed {
+		if a.Source == i.source && a.Topic == topic {
+			return a.Sequence, true
+		}
+	}
+	return 0, false
+}
+
+// Whether every peer, which stores the topic, completed the insertion
+func (i *inserter) acknowledged(ins *insertion) bool {
+	if len(i.peers) == 0 || !ins.numbered {
+		return false
+	}
+
+	for id := range i.peers {
+		mi, ok := i.metaInfos[id]
+		if !ok {
+			return false
+		}
+		if !newTopicFilter(mi.Topics).matches(ins.topic) {
+			continue
+		}
+
+		// Relays without the key never complete encrypted datasets
+		if ins.encrypted && !mi.decrypts(ins.topic) {
+			continue
+		}
+		if seq, ok := i.lastCompleted(mi, ins.topic); !ok || seq < ins.sequence {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget all retained insertions, which are complete everywhere
+func (i *inserter) pruneRetained() {
+	retained := i.retained[:0]
+	for _, ins := range i.retained {
+		if !i.acknowledged(ins) {
+			retained = append(retained, ins)
+		}
+	}
+	i.retained = retained
+}
+
+// Leave the standby mode and insert all retained insertions again
+func (i *inserter) processTakeOver() []*insertion {
+	if !i.standby {
+		return nil
+	}
+	i.standby = false
+
+	// Never reuse a sequence, which a peer already completed
+	for _, mi := range i.metaInfos {
+		for _, a := range mi.Completed {
+			if a.Source == i.source && a.Sequence >= i.sequences[a.Topic] {
+				i.sequences[a.Topic] = a.Sequence + 1
+			}
+		}
+	}
+
+	i.pruneRetained()
+	var reinserted []*insertion
+	for _, r := range i.retained {
+		ins := &insertion{ctx: context.Background(), topic: r.topic, sequence: r.sequence, numbered: r.numbered, buffer: r.buffer, encrypted: r.encrypted, ready: make(signalChan)}
+		reinserted = append(reinserted, ins)
+		i.processInsert(ins)
+	}
+	i.retained = nil
+	return reinserted
+}
+
+func (i *inserter) takeOver(ctx context.Context) error {
+	resChan := make(chan []*insertion, 1)
+
+	// Try to request the take over
+	select {
+	case i.takeOverChan <- resChan:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.done:
+		return errors.New("Inserter stopped while requesting take over")
+	}
+
+	// Wait for all insertions to complete,
+	// the ready channels are closed in any case
+	var errs multierror.Accumulator
+	for _, ins := range <-resChan {
+		select {
+		case <-ins.ready:
+			errs.Push(ins.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return errs.Error()
+}
@@ -0,0 +1,137 @@
+package gofoxnet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInserterStandby(t *testing.T) {
+	i := newInserter(publisherOptions{standby: true, source: 7})
+
+	l, r := net.Pipe()
+	i.addPeer(context.Background(), l)
+	writer, reader := remoteHandshake(t, r, receivingRole)
+
+	// Read all packets of the peer
+	packets := make(chan insertionPacket)
+	go func() {
+		for {
+			var packet insertionPacket
+			if err := receive(reader, &packet); err != nil {
+				close(packets)
+				return
+			}
+			packets <- packet
+		}
+	}()
+
+	// The peer reports right away, before anything was published
+	if err := writer.write(metaInfoMessage, &distributorMetaInfo{}); err != nil {
+		t.Fatal("Failed to send meta info:", err)
+	}
+
+	// Standby insertions are not sent
+	buffers := [][]byte{[]byte("hello"), []byte("world"), []byte("works")}
+	for _, b := range buffers {
+		res, err := i.insert(context.Background(), "", b)
+		if err != nil {
+			t.Fatal("Standby insertion failed:", err)
+		}
+		if res.Hash != (Hash{}) || len(res.Deliveries) != 0 {
+			t.Fatal("Unexpected standby result:", res)
+		}
+	}
+
+	// The peer completed the first two and five of another topic
+	mi := distributorMetaInfo{Completed: []streamAck{{7, "", 1}, {7, "other", 5}}}
+	if err := writer.write(metaInfoMessage, &mi); err != nil {
+		t.Fatal("Failed to send meta info:", err)
+	}
+
+	// Make sure the meta info was processed
+	time.Sleep(time.Millisecond * 100)
+
+	if err := i.takeOver(context.Background()); err != nil {
+		t.Fatal("Take over failed:", err)
+	}
+
+	// Only the incomplete insertion is sent again
+	packet := <-packets
+	if packet.Source != 7 || packet.Sequence != 2 || packet.Hash != SHA512_256Hash.MerkleRoot(buffers[2:]) {
+		t.Fatal("Wrong insertion sent again:", packet)
+	}
+
+	// Sequences continue after the completed ones
+	go i.insert(context.Background(), "other", []byte("again"))
+	if packet := <-packets; packet.Topic != "other" || packet.Sequence != 6 {
+		t.Fatal("Sequence not continued:", packet)
+	}
+
+	i.closeAndWait()
+}
+
+func TestInserterStandbyLate(t *testing.T) {
+	key := make([]byte, 32)
+	i := newInserter(publisherOptions{standby: true, source: 7, encryptionKeys: map[string][]byte{"secret": key}})
+
+	l, r := net.Pipe()
+	i.addPeer(context.Background(), l)
+	writer, reader := remoteHandshake(t, r, receivingRole)
+
+	packets := make(chan insertionPacket)
+	go func() {
+		for {
+			var packet insertionPacket
+			if err := receive(reader, &packet); err != nil {
+				close(packets)
+				return
+			}
+			packets <- packet
+		}
+	}()
+
+	// Numbered only once the stream position is known
+	if _, err := i.insert(context.Background(), "", []byte("hello")); err != nil {
+		t.Fatal("Standby insertion failed:", err)
+	}
+
+	// The active publisher completed five datasets before, the
+	// peer is a relay without the key of the encrypted topic
+	if err := writer.write(metaInfoMessage, &distributorMetaInfo{Completed: []streamAck{{7, "", 4}}}); err != nil {
+		t.Fatal("Failed to send meta info:", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	for _, topic := range []string{"secret", ""} {
+		if _, err := i.insert(context.Background(), topic, []byte("world")); err != nil {
+			t.Fatal("Standby insertion failed:", err)
+		}
+	}
+
+	// The first insertion completes
+	if err := writer.write(metaInfoMessage, &distributorMetaInfo{Completed: []streamAck{{7, "", 5}}}); err != nil {
+		t.Fatal("Failed to send meta info:", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	if err := i.takeOver(context.Background()); err != nil {
+		t.Fatal("Take over failed:", err)
+	}
+
+	// Only the last insertion is sent again, the relay
+	// never completes the encrypted one
+	packet := <-packets
+	if packet.Topic != "" || packet.Sequence != 6 || packet.Hash != SHA512_256Hash.MerkleRoot([][]byte{[]byte("world")}) {
+		t.Fatal("Wrong insertion sent again:", packet)
+	}
+
+	select {
+	case packet := <-packets:
+		t.Fatal("Unexpected insertion sent again:", packet)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	i.closeAndWait()
+}
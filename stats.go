@@ -0,0 +1,193 @@
+package gofoxnet
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// TrafficStats counts the traffic of one peer or of all peers of a role.
+type TrafficStats struct {
+	BytesSent       uint64
+	PacketsSent     uint64
+	BytesReceived   uint64
+	PacketsReceived uint64
+	EncodeErrors    uint64
+	DecodeErrors    uint64
+}
+
+// PeerStats is the traffic of a connected peer.
+type PeerStats struct {
+	Peer uint64
+	TrafficStats
+}
+
+// RoleStats is the traffic of all peers of a role, including removed
+// peers, and the traffic of every peer, which is still connected.
+type RoleStats struct {
+	TrafficStats
+	Peers []PeerStats
+}
+
+// PublisherStats is a snapshot of the statistics of a publisher.
+type PublisherStats struct {
+	Insertion RoleStats
+
+	// Publishes, which succeeded or failed
+	Published       uint64
+	PublishFailures uint64
+}
+
+// DistributorStats is a snapshot of the statistics of a distributor.
+type DistributorStats struct {
+	Receiving  RoleStats
+	Forwarding RoleStats
+	Collecting RoleStats
+
+	// Datasets, which were merged or failed to merge
+	DatasetsCompleted uint64
+	MergeFailures     uint64
+
+	// Datasets, which were removed to keep the capacity
+	DatasetsEvicted uint64
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Traffic counters, which are also added to the
+// counters of the role, accessed atomically
+type trafficCounters struct {
+	bytesSent       uint64
+	packetsSent     uint64
+	bytesReceived   uint64
+	packetsReceived uint64
+	encodeErrors    uint64
+	decodeErrors    uint64
+
+	// The counters of the role, nil for the role itself
+	role *trafficCounters
+}
+
+func (c *trafficCounters) sent(bytes int) {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.bytesSent, uint64(bytes))
+	}
+}
+
+func (c *trafficCounters) received(bytes int) {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.bytesReceived, uint64(bytes))
+	}
+}
+
+func (c *trafficCounters) packetSent() {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.packetsSent, 1)
+	}
+}
+
+func (c *trafficCounters) packetReceived() {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.packetsReceived, 1)
+	}
+}
+
+func (c *trafficCounters) encodeError() {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.encodeErrors, 1)
+	}
+}
+
+func (c *trafficCounters) decodeError() {
+	for ; c != nil; c = c.role {
+		atomic.AddUint64(&c.decodeErrors, 1)
+	}
+}
+
+// Count an encoding, which is either sent or failed
+func (c *trafficCounters) encoded(err error) {
+	if err != nil {
+		c.encodeError()
+	} else {
+		c.packetSent()
+	}
+}
+
+func (c *trafficCounters) snapshot() TrafficStats {
+	return TrafficStats{
+		atomic.LoadUint64(&c.bytesSent),
+		atomic.LoadUint64(&c.packetsSent),
+		atomic.LoadUint64(&c.bytesReceived),
+		atomic.LoadUint64(&c.packetsReceived),
+		atomic.LoadUint64(&c.encodeErrors),
+		atomic.LoadUint64(&c.decodeErrors),
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The traffic of all peers of a role, shared by the peers
+type roleCounters struct {
+	total trafficCounters
+
+	sync.Mutex
+	peers map[uint64]*trafficCounters
+}
+
+func newRoleCounters() *roleCounters {
+	return &roleCounters{peers: make(map[uint64]*trafficCounters)}
+}
+
+func (r *roleCounters) add(id uint64) *trafficCounters {
+	r.Lock()
+	defer r.Unlock()
+
+	c := &trafficCounters{role: &r.total}
+	r.peers[id] = c
+	return c
+}
+
+func (r *roleCounters) remove(id uint64) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.peers, id)
+}
+
+func (r *roleCounters) snapshot() RoleStats {
+	r.Lock()
+	defer r.Unlock()
+
+	stats := RoleStats{r.total.snapshot(), make([]PeerStats, 0, len(r.peers))}
+	for id, c := range r.peers {
+		stats.Peers = append(stats.Peers, PeerStats{id, c.snapshot()})
+	}
+	sort.Slice(stats.Peers, func(i, j int) bool { return stats.Peers[i].Peer < stats.Peers[j].Peer })
+	return stats
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Counts the bytes of a peer connection
+type countingReadWriteCloser struct {
+	io.ReadWriteCloser
+	traffic *trafficCounters
+}
+
+func (c *countingReadWriteCloser) Read(buffer []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(buffer)
+	c.traffic.received(n)
+	return n, err
+}
+
+func (c *countingReadWriteCloser) Write(buffer []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(buffer)
+	c.traffic.sent(n)
+	return n, err
+}
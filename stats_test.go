@@ -0,0 +1,48 @@
+package gofoxnet
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	p := NewPublisher()
+	dists := newMesh(p, nil, nil, nil)
+
+	buffer := []byte("helloworldworks")
+	res, err := p.Publish(buffer)
+	if err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	for i, d := range dists {
+		if _, err := d.Lookup(res.Hash); err != nil {
+			t.Fatal("Lookup of peer", i, "failed, Reason:", err)
+		}
+	}
+
+	ps := p.Stats()
+	if ps.Published != 1 || ps.PublishFailures != 0 {
+		t.Fatal("Wrong number of publishes:", ps)
+	}
+
+	// Every peer counts its hello as well
+	if ps.Insertion.PacketsSent != 6 || ps.Insertion.BytesSent <= uint64(len(buffer)) {
+		t.Fatal("Wrong insertion traffic:", ps.Insertion.TrafficStats)
+	}
+	if len(ps.Insertion.Peers) != 3 {
+		t.Fatal("Traffic of", len(ps.Insertion.Peers), "peers instead of 3")
+	}
+
+	for i, d := range dists {
+		ds := d.Stats()
+		if ds.DatasetsCompleted != 1 || ds.MergeFailures != 0 {
+			t.Fatal("Peer", i, "has wrong dataset stats:", ds)
+		}
+		if ds.Receiving.PacketsReceived != 2 {
+			t.Fatal("Peer", i, "received", ds.Receiving.PacketsReceived, "insertion packets")
+		}
+		if ds.Collecting.PacketsReceived != 4 || ds.Collecting.BytesReceived == 0 {
+			t.Fatal("Peer", i, "has wrong collecting traffic:", ds.Collecting.TrafficStats)
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
@@ -0,0 +1,160 @@
+package gofoxnet
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PeerStatus is the last status a distributor reported to the publisher.
+type PeerStatus struct {
+	Peer PeerId
+
+	// When the status was received, zero if there was no report yet
+	Received time.Time
+
+	// Measured forwarding throughput in bytes per second
+	// and the number of chunks waiting to be forwarded
+	UploadCapacity float64
+	QueueDepth     int
+
+	// Datasets merged so far and chunks,
+	// which incomplete datasets still need
+	DatasetsCompleted int
+	ChunksMissing     int
+
+	// The throughput to every forwarding peer
+	Forwarding []ForwardingStatus
+
+	// Bytes allocated by the distributor and bytes the system of the
+	// distributor has available, which is only known on Linux
+	MemoryInUse     uint64
+	MemoryAvailable uint64
+}
+
+// ForwardingStatus is the throughput of a distributor to one of its peers.
+type ForwardingStatus struct {
+	// The id of the peer, unique within the distributor
+	Peer uint64
+
+	// Bytes per second
+	Throughput float64
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The memory available for new allocations without swapping,
+// zero if the system does not report it
+func availableMemory() uint64 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "MemAvailable:" && fields[2] == "kB" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb << 10
+		}
+	}
+	return 0
+}
+
+// Collect the meta info a distributor reports
+func (r *receiver) metaInfo() distributorMetaInfo {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	status := r.database.status()
+	return distributorMetaInfo{
+		UploadCapacity:    r.forwarder.uploadCapacity(),
+		QueueDepth:        r.forwarder.queueDepth(),
+		Topics:            r.topics.interest().Topics,
+		Completed:         status.completed,
+		Decrypts:          r.database.decryptedTopics(),
+		Compressions:      supportedCompressions,
+		DatasetsCompleted: status.merged,
+		ChunksMissing:     status.missingChunks,
+		Forwarding:        r.forwarder.status(),
+		MemoryInUse:       m.HeapAlloc,
+		MemoryAvailable:   availableMemory(),
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type databaseStatus struct {
+	completed     []streamAck
+	merged        int
+	missingChunks int
+}
+
+func (d *database) currentStatus() databaseStatus {
+	missing := 0
+	for _, ds := range d.datasets {
+		if ds.mergeResult == nil || ds.mergeResult.err != nil {
+			if m := ds.requiredChunks() - len(ds.chunks); m > 0 {
+				missing += m
+			}
+		}
+	}
+	return databaseStatus{d.completedStreams(), int(atomic.LoadUint64(&d.merged)), missing}
+}
+
+func (d *database) status() databaseStatus {
+	resChan := make(chan databaseStatus, 1)
+
+	select {
+	case d.statusChan <- resChan:
+		return <-resChan
+	case <-d.done:
+		return databaseStatus{}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+func (i *inserter) peerStatus() []PeerStatus {
+	status := make([]PeerStatus, 0, len(i.peers))
+	for id := range i.peers {
+		mi := i.metaInfos[id]
+		status = append(status, PeerStatus{
+			id,
+			mi.received,
+			mi.UploadCapacity,
+			mi.QueueDepth,
+			mi.DatasetsCompleted,
+			mi.ChunksMissing,
+			mi.Forwarding,
+			mi.MemoryInUse,
+			mi.MemoryAvailable,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Peer < status[j].Peer })
+	return status
+}
+
+func (i *inserter) status() []PeerStatus {
+	resChan := make(chan []PeerStatus, 1)
+
+	select {
+	case i.statusChan <- resChan:
+		return <-resChan
+	case <-i.done:
+		return nil
+	}
+}
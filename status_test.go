@@ -0,0 +1,44 @@
+package gofoxnet
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPeerStatus(t *testing.T) {
+	p := NewPublisher()
+	dists := newMesh(p, nil, nil, nil)
+
+	if _, err := p.Publish([]byte("helloworldworks")); err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	// Wait for the next periodic report
+	time.Sleep(metaInfoInterval + 200*time.Millisecond)
+
+	status := p.PeerStatus()
+	if len(status) != len(dists) {
+		t.Fatal("Status of", len(status), "peers instead of", len(dists))
+	}
+
+	for _, s := range status {
+		if s.Received.IsZero() {
+			t.Fatal("Peer", s.Peer, "did not report")
+		}
+		if s.DatasetsCompleted != 1 || s.ChunksMissing != 0 {
+			t.Fatal("Peer", s.Peer, "reported wrong datasets:", s)
+		}
+		if len(s.Forwarding) != len(dists)-1 {
+			t.Fatal("Peer", s.Peer, "reported wrong forwarding peers:", s.Forwarding)
+		}
+		if s.MemoryInUse == 0 {
+			t.Fatal("Peer", s.Peer, "reported no memory")
+		}
+		if runtime.GOOS == "linux" && s.MemoryAvailable == 0 {
+			t.Fatal("Peer", s.Peer, "reported no available memory")
+		}
+	}
+
+	closeMesh(t, p, dists)
+}
@@ -0,0 +1,263 @@
+package gofoxnet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Store keeps the metadata and the verified chunks of the datasets
+// of a distributor. It is only used by one distributor at a time.
+type Store interface {
+	// PutMetadata stores the encoded metadata of a dataset,
+	// it replaces the metadata stored before
+	PutMetadata(hash Hash, metadata []byte) error
+
+	// PutChunk stores a chunk of a dataset
+	PutChunk(hash Hash, index int, buffer []byte) error
+
+	// Chunk returns a stored chunk of a dataset
+	Chunk(hash Hash, index int) ([]byte, error)
+
+	// Remove deletes the metadata and all chunks of a dataset
+	Remove(hash Hash) error
+
+	// Load calls f with the metadata of every stored dataset
+	// and the sizes of its chunks by index
+	Load(f func(hash Hash, metadata []byte, chunks map[int]int)) error
+}
+
+var errChunkNotStored = errors.New("Chunk not stored")
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type memoryStore struct {
+	metadata map[Hash][]byte
+	chunks   map[Hash]map[int][]byte
+}
+
+// NewMemoryStore creates a store, which keeps everything in memory.
+// It is the default store of a distributor.
+func NewMemoryStore() Store {
+	return &memoryStore{make(map[Hash][]byte), make(map[Hash]map[int][]byte)}
+}
+
+func (s *memoryStore) PutMetadata(hash Hash, metadata []byte) error {
+	s.metadata[hash] = metadata
+	return nil
+}
+
+func (s *memoryStore) PutChunk(hash Hash, index int, buffer []byte) error {
+	m, ok := s.chunks[hash]
+	if !ok {
+		m = make(map[int][]byte)
+		s.chunks[hash] = m
+	}
+	m[index] = buffer
+	return nil
+}
+
+func (s *memoryStore) Chunk(hash Hash, index int) ([]byte, error) {
+	b, ok := s.chunks[hash][index]
+	if !ok {
+		return nil, errChunkNotStored
+	}
+	return b, nil
+}
+
+func (s *memoryStore) Remove(hash Hash) error {
+	delete(s.metadata, hash)
+	delete(s.chunks, hash)
+	return nil
+}
+
+func (s *memoryStore) Load(f func(hash Hash, metadata []byte, chunks map[int]int)) error {
+	for hash, md := range s.metadata {
+		chunks := make(map[int]int)
+		for i, c := range s.chunks[hash] {
+			chunks[i] = len(c)
+		}
+		f(hash, md, chunks)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Every dataset is a directory named by its hash, which
+// contains the metadata and one file per chunk
+type fileStore struct {
+	dir string
+}
+
+const metadataFile = "metadata"
+
+// NewFileStore creates a store, which writes to the given directory.
+// Datasets, which are already stored there, are loaded by the
+// distributor on start up.
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir}, nil
+}
+
+func (s *fileStore) path(hash Hash, name string) string {
+	return filepath.Join(s.dir, hash.String(), name)
+}
+
+// Write to a temporary file and sync it before renaming,
+// so a crash never leaves a partially written file behind
+func (s *fileStore) write(hash Hash, name string, buffer []byte) error {
+	dir := filepath.Join(s.dir, hash.String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := s.path(hash, name)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buffer); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// Persist the rename, not every system is able to sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (s *fileStore) PutMetadata(hash Hash, metadata []byte) error {
+	return s.write(hash, metadataFile, metadata)
+}
+
+func (s *fileStore) PutChunk(hash Hash, index int, buffer []byte) error {
+	return s.write(hash, strconv.Itoa(index), buffer)
+}
+
+func (s *fileStore) Chunk(hash Hash, index int) ([]byte, error) {
+	b, err := os.ReadFile(s.path(hash, strconv.Itoa(index)))
+	if os.IsNotExist(err) {
+		return nil, errChunkNotStored
+	}
+	return b, err
+}
+
+func (s *fileStore) Remove(hash Hash) error {
+	return os.RemoveAll(filepath.Join(s.dir, hash.String()))
+}
+
+func (s *fileStore) Load(f func(hash Hash, metadata []byte, chunks map[int]int)) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		hash, err := ParseHash(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+
+		// Chunks without metadata cannot be verified
+		md, err := os.ReadFile(s.path(hash, metadataFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		files, err := os.ReadDir(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+
+		chunks := make(map[int]int)
+		for _, c := range files {
+			i, err := strconv.Atoi(c.Name())
+			if err != nil {
+				continue
+			}
+			info, err := c.Info()
+			if err != nil {
+				return err
+			}
+			chunks[i] = int(info.Size())
+		}
+		f(hash, md, chunks)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// The metadata of a dataset and all positions it was published at
+func encodeMetadata(md metadata, positions []streamPosition) []byte {
+	var w binaryWriter
+	w.hash(md.hash)
+	w.int(int64(md.chunkCount))
+	w.uint(uint64(md.algorithm))
+	w.int(int64(md.dataShards))
+	w.int(int64(md.size))
+	w.bool(md.encrypted)
+	w.uint(uint64(len(positions)))
+	for _, p := range positions {
+		w.uint(p.source)
+		w.string(p.topic)
+		w.uint(p.sequence)
+	}
+	return w.Bytes()
+}
+
+func decodeMetadata(data []byte) (metadata, []streamPosition, error) {
+	var md metadata
+	var positions []streamPosition
+
+	r := binaryReader{data: data}
+	md.hash = r.hash()
+	md.chunkCount = int(r.int())
+	md.algorithm = HashAlgorithm(r.uint())
+	md.dataShards = int(r.int())
+	md.size = int(r.int())
+	md.encrypted = r.bool()
+	for n := r.length(); n > 0; n-- {
+		positions = append(positions, streamPosition{streamKey{r.uint(), r.string()}, r.uint()})
+	}
+
+	if r.err != nil {
+		return md, nil, r.err
+	}
+	if len(positions) == 0 {
+		return md, nil, fmt.Errorf("Dataset %v has no position", md.hash)
+	}
+	if err := md.validate(); err != nil {
+		return md, nil, err
+	}
+
+	// The first position is the one of the metadata
+	md.source, md.topic, md.sequence = positions[0].source, positions[0].topic, positions[0].sequence
+	return md, positions, nil
+}
@@ -0,0 +1,122 @@
+package gofoxnet
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	file, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal("Failed to create file store:", err)
+	}
+
+	for _, s := range []Store{NewMemoryStore(), file} {
+		h := Sum([]byte("hash"))
+		s.PutMetadata(h, []byte("old"))
+		s.PutMetadata(h, []byte("metadata"))
+		s.PutChunk(h, 0, []byte("hello"))
+		s.PutChunk(h, 2, []byte("works"))
+
+		loaded := 0
+		err := s.Load(func(hash Hash, metadata []byte, chunks map[int]int) {
+			loaded++
+			if hash != h || string(metadata) != "metadata" || len(chunks) != 2 || chunks[2] != 5 {
+				t.Fatal("Wrong dataset loaded:", hash, string(metadata), chunks)
+			}
+		})
+		if err != nil || loaded != 1 {
+			t.Fatal("Loaded", loaded, "datasets:", err)
+		}
+
+		if c, err := s.Chunk(h, 2); err != nil || !bytes.Equal(c, []byte("works")) {
+			t.Fatal("Wrong chunk:", string(c), err)
+		}
+		if _, err := s.Chunk(h, 1); err == nil {
+			t.Fatal("Missing chunk found")
+		}
+
+		s.Remove(h)
+		if _, err := s.Chunk(h, 0); err == nil {
+			t.Fatal("Removed chunk found")
+		}
+	}
+}
+
+func TestDatabaseReload(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir)
+	d := newDatabase(nil, databaseLimits{}, store)
+
+	// One complete and one incomplete dataset
+	b := []byte("helloworld")
+	h1 := addTestDataset(d, b, 0)
+	h2, chunks := newTestChunks([][]byte{[]byte("hello"), []byte("works")})
+	d.addMetaData(metadata{h2, 2, SHA512_256Hash, 0, 10, false, 0, "", 1})
+	d.addChunk(chunks[0])
+	d.closeAndWait()
+
+	// Both are restored after a restart, but not merged yet
+	store, _ = NewFileStore(dir)
+	d = newDatabase(nil, databaseLimits{}, store)
+	if d.bytes != len(b)+len("hello") {
+		t.Fatal("Restored dataset merged before use:", d.bytes)
+	}
+	if m, err := d.lookup(context.Background(), h1); err != nil || !bytes.Equal(m, b) {
+		t.Fatal("Lookup of complete dataset failed:", err)
+	}
+
+	d.addChunk(chunks[1])
+	if m, err := d.lookup(context.Background(), h2); err != nil || !bytes.Equal(m, []byte("helloworks")) {
+		t.Fatal("Lookup of incomplete dataset failed:", err)
+	}
+
+	// The restored stream continues
+	if acks := d.status().completed; len(acks) != 1 || acks[0].Sequence != 1 {
+		t.Fatal("Wrong streams restored:", acks)
+	}
+
+	d.closeAndWait()
+}
+
+func TestDatabaseReloadCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewFileStore(dir)
+	d := newDatabase(nil, databaseLimits{}, store)
+	h := addTestDataset(d, []byte("helloworld"), 0)
+	d.closeAndWait()
+
+	// The chunk is changed on disk
+	if err := os.WriteFile(filepath.Join(dir, h.String(), "0"), []byte("hellowords"), 0644); err != nil {
+		t.Fatal("Failed to change chunk:", err)
+	}
+
+	store, _ = NewFileStore(dir)
+	d = newDatabase(nil, databaseLimits{}, store)
+	if _, err := d.lookup(context.Background(), h); err == nil {
+		t.Fatal("Corrupted dataset merged")
+	}
+	d.closeAndWait()
+}
+
+func TestMetadataInvalid(t *testing.T) {
+	pos := []streamPosition{{streamKey{0, ""}, 0}}
+	if _, _, err := decodeMetadata(encodeMetadata(metadata{Sum(nil), 2, SHA512_256Hash, 1, 10, false, 0, "", 0}, pos)); err != nil {
+		t.Fatal("Valid metadata rejected:", err)
+	}
+
+	for _, md := range []metadata{
+		{Sum(nil), 0, SHA512_256Hash, 0, 10, false, 0, "", 0},
+		{Sum(nil), 1 << 40, SHA512_256Hash, 1, 10, false, 0, "", 0},
+		{Sum(nil), 2, SHA512_256Hash, 3, 10, false, 0, "", 0},
+		{Sum(nil), 2, SHA512_256Hash, -1, 10, false, 0, "", 0},
+		{Sum(nil), 2, SHA512_256Hash, 0, -10, false, 0, "", 0},
+	} {
+		if _, _, err := decodeMetadata(encodeMetadata(md, pos)); err == nil {
+			t.Fatal("Invalid metadata accepted:", md.chunkCount, md.dataShards, md.size)
+		}
+	}
+}
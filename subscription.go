@@ -0,0 +1,286 @@
+package gofoxnet
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Dataset is a completely received and verified buffer.
+// Source identifies the publisher, which assigned the sequence.
+type Dataset struct {
+	Source   uint64
+	Topic    string
+	Sequence uint64
+	Hash     Hash
+	Buffer   []byte
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+// Identifies the stream of one publisher and topic
+type streamKey struct {
+	source uint64
+	topic  string
+}
+
+// The place of a dataset in a stream
+type streamPosition struct {
+	streamKey
+	sequence uint64
+}
+
+// Reorders the datasets of one stream
+type stream struct {
+	// The next sequence number to deliver
+	next uint64
+
+	// Whether the next sequence number is known
+	// and whether anything was delivered yet
+	known     bool
+	delivered bool
+
+	// Complete datasets waiting for their predecessors
+	// and evicted datasets, which are never delivered
+	completed map[uint64]Dataset
+	skipped   map[uint64]bool
+
+	// Since when complete datasets wait for a
+	// missing predecessor, zero if none waits
+	waiting time.Time
+}
+
+// Remember the lowest sequence number seen before the first
+// delivery, so a distributor can join a running stream
+func (s *stream) announce(sequence uint64) {
+	if !s.delivered && (!s.known || sequence < s.next) {
+		s.next = sequence
+		s.known = true
+	}
+}
+
+// Add a complete dataset and return all datasets,
+// which can be delivered in order now
+func (s *stream) complete(ds Dataset) []Dataset {
+	if s.delivered && ds.Sequence < s.next {
+		return nil
+	}
+	s.completed[ds.Sequence] = ds
+	return s.advance()
+}
+
+// Give up on an evicted dataset and return all datasets,
+// which can be delivered in order now
+func (s *stream) skip(sequence uint64) []Dataset {
+	if s.delivered && sequence < s.next {
+		return nil
+	}
+	delete(s.completed, sequence)
+	s.skipped[sequence] = true
+	return s.advance()
+}
+
+// Give up on the missing sequences before the first
+// waiting dataset and return all datasets, which can
+// be delivered in order now
+func (s *stream) skipGap() []Dataset {
+	if len(s.completed) == 0 {
+		return nil
+	}
+
+	first := true
+	for sequence := range s.completed {
+		if first || sequence < s.next {
+			s.next = sequence
+			first = false
+		}
+	}
+	for sequence := range s.skipped {
+		if sequence < s.next {
+			delete(s.skipped, sequence)
+		}
+	}
+	s.delivered = true
+	return s.advance()
+}
+
+func (s *stream) advance() []Dataset {
+	var ready []Dataset
+	start := s.next
+	for {
+		if s.skipped[s.next] {
+			delete(s.skipped, s.next)
+			s.next++
+			s.delivered = true
+			continue
+		}
+
+		next, ok := s.completed[s.next]
+		if !ok {
+			break
+		}
+		delete(s.completed, s.next)
+		ready = append(ready, next)
+		s.next++
+		s.delivered = true
+	}
+
+	// The wait for the next missing sequence starts now
+	if len(s.completed) == 0 {
+		s.waiting = time.Time{}
+	} else if s.waiting.IsZero() || s.next != start {
+		s.waiting = time.Now()
+	}
+	return ready
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+type subscription struct {
+	ctx context.Context
+
+	// The database sends to in, which never blocks,
+	// the subscriber receives from out
+	in  chan Dataset
+	out chan Dataset
+
+	// Asks the database to remove the subscription
+	unsubscribe chan<- *subscription
+}
+
+func newSubscription(ctx context.Context, unsubscribe chan<- *subscription) *subscription {
+	s := &subscription{ctx, make(chan Dataset), make(chan Dataset), unsubscribe}
+	go s.processQueue()
+	return s
+}
+
+// Buffers datasets, so the database never waits for a slow subscriber
+func (s *subscription) processQueue() {
+	var queue []Dataset
+	var unsubscribe chan<- *subscription
+	out := s.out
+	done := s.ctx.Done()
+	for {
+		// Only try to output, if there is something queued
+		var next Dataset
+		var outChan chan Dataset
+		if len(queue) > 0 && out != nil {
+			next = queue[0]
+			outChan = out
+		}
+
+		select {
+		case ds, ok := <-s.in:
+			if !ok {
+				if out != nil {
+					close(out)
+				}
+				return
+			}
+			if out != nil {
+				queue = append(queue, ds)
+			}
+		case outChan <- next:
+			queue = queue[1:]
+		case <-done:
+			// Stop delivering, but drain until the database
+			// removes this subscription
+			close(out)
+			out, queue, done = nil, nil, nil
+			unsubscribe = s.unsubscribe
+		case unsubscribe <- s:
+			unsubscribe = nil
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+//////////////////////////////////////////////////////////////////////////
+
+func (d *database) stream(key streamKey) *stream {
+	s, ok := d.streams[key]
+	if !ok {
+		s = &stream{completed: make(map[uint64]Dataset), skipped: make(map[uint64]bool)}
+		d.streams[key] = s
+	}
+	return s
+}
+
+// Skip the missing sequences of streams, which waited too long
+func (d *database) skipGaps(now time.Time) {
+	for _, s := range d.streams {
+		if !s.waiting.IsZero() && now.Sub(s.waiting) >= d.limits.sequenceTimeout {
+			d.deliver(s.skipGap())
+		}
+	}
+}
+
+// Deliver the complete dataset in order to all subscriptions
+func (d *database) publish(ds *dataset, pos streamPosition) {
+	d.deliver(d.stream(pos.streamKey).complete(Dataset{pos.source, pos.topic, pos.sequence, ds.hash, nil}))
+}
+
+// Send datasets, which are ready in order, to all subscriptions,
+// datasets restored from the store are only merged now
+func (d *database) deliver(ready []Dataset) {
+	if len(d.subscriptions) == 0 {
+		return
+	}
+
+	for _, r := range ready {
+		ds, ok := d.datasets[r.Hash]
+		if !ok {
+			continue
+		}
+
+		res := d.merge(ds)
+		if res.err != nil {
+			log.Println("Failed to deliver dataset", r.Hash, res.err)
+			continue
+		}
+		r.Buffer = res.buffer
+
+		for _, s := range d.subscriptions {
+			s.in <- r
+		}
+	}
+}
+
+// Remove a cancelled subscription
+func (d *database) unsubscribe(s *subscription) {
+	for i, other := range d.subscriptions {
+		if other == s {
+			d.subscriptions = append(d.subscriptions[:i], d.subscriptions[i+1:]...)
+			close(s.in)
+			return
+		}
+	}
+}
+
+// The last sequence delivered in order of every stream
+func (d *database) completedStreams() []streamAck {
+	var acks []streamAck
+	for key, s := range d.streams {
+		if s.delivered {
+			acks = append(acks, streamAck{key.source, key.topic, s.next - 1})
+		}
+	}
+	return acks
+}
+
+func (d *database) subscribe(ctx context.Context) <-chan Dataset {
+	s := newSubscription(ctx, d.unsubscribeChan)
+
+	select {
+	case d.subscribeChan <- s:
+	case <-d.done:
+		close(s.in)
+	}
+
+	return s.out
+}
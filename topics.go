@@ -0,0 +1,41 @@
+package gofoxnet
+
+import "sort"
+
+// Sent by collecting peers to tell the remote
+// forwarder, which topics they care about
+type topicInterest struct {
+	// Empty means all topics
+	Topics []string
+
+	// The compressions the collecting peer is able to decompress
+	Compressions []Compression
+}
+
+// A set of topics, nil matches all topics
+type topicFilter map[string]bool
+
+func newTopicFilter(topics []string) topicFilter {
+	if len(topics) == 0 {
+		return nil
+	}
+
+	f := make(topicFilter, len(topics))
+	for _, t := range topics {
+		f[t] = true
+	}
+	return f
+}
+
+func (f topicFilter) matches(topic string) bool {
+	return f == nil || f[topic]
+}
+
+func (f topicFilter) interest() topicInterest {
+	var topics []string
+	for t := range f {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topicInterest{topics, supportedCompressions}
+}